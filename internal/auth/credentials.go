@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sharedClient is the client authenticated by the single api.token, which
+// keeps every scope
+var sharedClient = &Client{Name: "default", Scopes: []string{ScopeAll}}
+
+// CredentialLoader returns the API clients and the decrypted shared token,
+// which is empty if none is configured
+type CredentialLoader func() (*Registry, string, error)
+
+// Credentials holds the secrets requests are authenticated with. They are
+// loaded once and kept in memory, so authenticating a request does no disk
+// I/O or decryption; Reload picks up rotated secrets.
+type Credentials struct {
+	load CredentialLoader
+
+	mu         sync.RWMutex
+	registry   *Registry
+	sharedHash []byte // SHA-256 of the shared token, nil if none
+}
+
+// NewCredentials creates credentials from what load returns, calling it
+// again on every reload
+func NewCredentials(load CredentialLoader) (*Credentials, error) {
+	c := &Credentials{load: load}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload replaces the credentials. The current ones are kept if the new ones
+// cannot be loaded.
+func (c *Credentials) Reload() error {
+	registry, shared, err := c.load()
+	if err != nil {
+		return fmt.Errorf("error loading api credentials: %v", err)
+	}
+	var sharedHash []byte
+	if shared != "" {
+		hash := sha256.Sum256([]byte(shared))
+		sharedHash = hash[:]
+	}
+
+	c.mu.Lock()
+	c.registry = registry
+	c.sharedHash = sharedHash
+	c.mu.Unlock()
+
+	log.Info().
+		Int("clients", registry.Len()).
+		Bool("shared_token", sharedHash != nil).
+		Msg("API credentials loaded")
+	return nil
+}
+
+// Authenticate returns the client a bearer token belongs to, trying the
+// registered clients before the shared token. Tokens are compared by hash
+// in constant time.
+func (c *Credentials) Authenticate(token string) (*Client, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if client, ok := c.registry.Authenticate(token); ok {
+		return client, true
+	}
+	if c.sharedHash == nil {
+		return nil, false
+	}
+	hash := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(hash[:], c.sharedHash) == 1 {
+		return sharedClient, true
+	}
+	return nil, false
+}
+
+// AuthenticateCertificate returns the client a verified TLS client
+// certificate belongs to
+func (c *Credentials) AuthenticateCertificate(cert *x509.Certificate) (*Client, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.registry.AuthenticateCertificate(cert)
+}
+
+// Configured reports whether any client or the shared token is configured
+func (c *Credentials) Configured() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.registry.Len() > 0 || c.sharedHash != nil
+}
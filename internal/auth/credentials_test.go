@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T, clients ...Client) *Registry {
+	t.Helper()
+	registry, err := NewRegistry(clients)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	return registry
+}
+
+func TestCredentialsAuthenticate(t *testing.T) {
+	registry := newTestRegistry(t,
+		Client{Name: "ci", TokenHash: HashToken("ci-token"), Scopes: []string{ScopeCopilotInvite}},
+		Client{Name: "reports", TokenHash: HashToken("reports-token"), Scopes: []string{ScopeOrgsRead}},
+	)
+	credentials, err := NewCredentials(func() (*Registry, string, error) {
+		return registry, "shared-token", nil
+	})
+	if err != nil {
+		t.Fatalf("NewCredentials: %v", err)
+	}
+
+	tests := []struct {
+		token string
+		want  string // client name, empty if rejected
+	}{
+		{"ci-token", "ci"},
+		{"reports-token", "reports"},
+		{"shared-token", "default"},
+		// Near misses differ in length or share a prefix with a valid token
+		{"ci-token ", ""},
+		{"ci-toke", ""},
+		{"CI-TOKEN", ""},
+		{"shared-token-2", ""},
+		{"shared", ""},
+		{HashToken("ci-token"), ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		client, ok := credentials.Authenticate(tt.token)
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("Authenticate(%q) = %s, want rejected", tt.token, client.Name)
+		case tt.want != "" && (!ok || client.Name != tt.want):
+			t.Errorf("Authenticate(%q) = %v, %v, want %s", tt.token, client, ok, tt.want)
+		}
+	}
+}
+
+func TestTokensComparedByHash(t *testing.T) {
+	registry := newTestRegistry(t,
+		Client{Name: "ci", TokenHash: HashToken("ci-token"), Scopes: []string{ScopeCopilotInvite}},
+		Client{Name: "deploy", TokenHash: HashToken("a much longer deploy token"), Scopes: []string{ScopeCopilotInvite}},
+	)
+	credentials, err := NewCredentials(func() (*Registry, string, error) {
+		return registry, "shared-token", nil
+	})
+	if err != nil {
+		t.Fatalf("NewCredentials: %v", err)
+	}
+
+	// Only fixed-size hashes are held and compared, so subtle.ConstantTimeCompare
+	// never returns early on a length mismatch and the time taken does not
+	// depend on the length or content of the presented token
+	for i, hash := range registry.hashes {
+		if len(hash) != 32 {
+			t.Errorf("registry hash %d has %d bytes, want 32", i, len(hash))
+		}
+	}
+	if len(credentials.sharedHash) != 32 {
+		t.Errorf("shared token hash has %d bytes, want 32", len(credentials.sharedHash))
+	}
+	if string(credentials.sharedHash) == "shared-token" {
+		t.Error("shared token is kept in plain text")
+	}
+}
+
+func TestCredentialsReload(t *testing.T) {
+	ci := Client{Name: "ci", TokenHash: HashToken("old-ci-token"), Scopes: []string{ScopeCopilotInvite}}
+	registry := newTestRegistry(t, ci)
+	shared := "old-shared-token"
+	var loadErr error
+	credentials, err := NewCredentials(func() (*Registry, string, error) {
+		if loadErr != nil {
+			return nil, "", loadErr
+		}
+		return registry, shared, nil
+	})
+	if err != nil {
+		t.Fatalf("NewCredentials: %v", err)
+	}
+
+	// Rotated tokens replace the old ones right away
+	ci.TokenHash = HashToken("new-ci-token")
+	registry = newTestRegistry(t, ci)
+	shared = "new-shared-token"
+	if err := credentials.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	for token, want := range map[string]bool{
+		"old-ci-token": false, "new-ci-token": true,
+		"old-shared-token": false, "new-shared-token": true,
+	} {
+		if _, ok := credentials.Authenticate(token); ok != want {
+			t.Errorf("after reload Authenticate(%q) = %v, want %v", token, ok, want)
+		}
+	}
+
+	// An invalid configuration is rejected and the current tokens stay in use
+	loadErr = errors.New("api client ci has no scopes")
+	if err := credentials.Reload(); err == nil {
+		t.Error("expected the load error")
+	}
+	if _, ok := credentials.Authenticate("new-ci-token"); !ok {
+		t.Error("a failed reload dropped the client tokens")
+	}
+	if _, ok := credentials.Authenticate("new-shared-token"); !ok {
+		t.Error("a failed reload dropped the shared token")
+	}
+
+	// Removing the shared token disables it
+	loadErr = nil
+	shared = ""
+	if err := credentials.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, ok := credentials.Authenticate("new-shared-token"); ok {
+		t.Error("the removed shared token still authenticates")
+	}
+	if !credentials.Configured() {
+		t.Error("credentials with a client are reported as not configured")
+	}
+}
+
+func TestNewCredentialsLoadError(t *testing.T) {
+	if _, err := NewCredentials(func() (*Registry, string, error) { return nil, "", errors.New("config unreadable") }); err == nil {
+		t.Error("expected the load error")
+	}
+}
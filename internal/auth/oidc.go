@@ -0,0 +1,504 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// clockSkew is how far token times may be off from ours
+	clockSkew = time.Minute
+	// jwksRefetchInterval limits how often an unknown key ID reloads the key set
+	jwksRefetchInterval = time.Minute
+	// SubjectPrefix is prepended to the subject of a token without an email
+	// address, so it cannot be mistaken for an API client name
+	SubjectPrefix = "oidc:"
+)
+
+// ErrInvalidToken is returned for a JWT that fails verification
+var ErrInvalidToken = errors.New("invalid token")
+
+// OIDCConfig holds the settings for accepting JWTs from an identity provider
+type OIDCConfig struct {
+	Issuer       string        `mapstructure:"issuer"`
+	Audience     string        `mapstructure:"audience"`
+	JWKSURL      string        `mapstructure:"jwks_url"`
+	JWKSFile     string        `mapstructure:"jwks_file"`
+	JWKSCacheTTL time.Duration `mapstructure:"jwks_cache_ttl"`
+	GroupsClaim  string        `mapstructure:"groups_claim"`
+	EmailClaim   string        `mapstructure:"email_claim"`
+	Roles        []OIDCRole    `mapstructure:"roles"`
+}
+
+// OIDCRole grants scopes to the users of a token whose groups or email match
+type OIDCRole struct {
+	Name   string   `mapstructure:"name"`
+	Groups []string `mapstructure:"groups"`
+	Emails []string `mapstructure:"emails"`
+	Scopes []string `mapstructure:"scopes"`
+	Orgs   []string `mapstructure:"orgs"` // empty allows every organization
+}
+
+// matches reports whether a role applies to a user
+func (r *OIDCRole) matches(email string, groups []string) bool {
+	for _, allowed := range r.Emails {
+		if email != "" && strings.EqualFold(allowed, email) {
+			return true
+		}
+	}
+	for _, allowed := range r.Groups {
+		for _, group := range groups {
+			if allowed == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verifier checks JWTs against the key set of an identity provider and turns
+// them into clients
+type Verifier struct {
+	config OIDCConfig
+	http   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time     // last reload, successful or not
+	loading   chan struct{} // closed when the reload in progress is done
+}
+
+// NewVerifier creates a verifier and loads its key set
+func NewVerifier(config OIDCConfig) (*Verifier, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("oidc needs an issuer and an audience")
+	}
+	if (config.JWKSURL == "") == (config.JWKSFile == "") {
+		return nil, errors.New("oidc needs exactly one of jwks_url and jwks_file")
+	}
+	if config.JWKSCacheTTL <= 0 {
+		config.JWKSCacheTTL = time.Hour
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.EmailClaim == "" {
+		config.EmailClaim = "email"
+	}
+	for i, role := range config.Roles {
+		if role.Name == "" {
+			return nil, fmt.Errorf("oidc role %d has no name", i+1)
+		}
+		if len(role.Scopes) == 0 {
+			return nil, fmt.Errorf("oidc role %s has no scopes", role.Name)
+		}
+	}
+
+	v := &Verifier{
+		config: config,
+		http:   &http.Client{Timeout: 10 * time.Second},
+	}
+	keys, err := v.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+	v.attempted = v.fetched
+	return v, nil
+}
+
+// Authenticate verifies a JWT and returns the client it stands for: the user
+// named by its email, or by its subject behind SubjectPrefix, with the scopes
+// and organizations of every role they match. An email the provider has not
+// verified (email_verified is not true) is ignored, so it can neither match a
+// role nor name the user. A user matching no role is refused.
+func (v *Verifier) Authenticate(token string) (*Client, error) {
+	claims, err := v.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	email, _ := claims[v.config.EmailClaim].(string)
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		email = ""
+	}
+	subject, _ := claims["sub"].(string)
+	groups := stringList(claims[v.config.GroupsClaim])
+
+	// API client names cannot contain @, see NewRegistry
+	client := &Client{Name: email, Groups: groups}
+	if !strings.Contains(email, "@") {
+		if subject == "" {
+			return nil, fmt.Errorf("%w: no email or subject", ErrInvalidToken)
+		}
+		client.Name = SubjectPrefix + subject
+	}
+	allOrgs := false
+	for i := range v.config.Roles {
+		role := &v.config.Roles[i]
+		if !role.matches(email, groups) {
+			continue
+		}
+		client.Scopes = append(client.Scopes, role.Scopes...)
+		if len(role.Orgs) == 0 {
+			allOrgs = true
+		}
+		client.Orgs = append(client.Orgs, role.Orgs...)
+	}
+	if len(client.Scopes) == 0 {
+		return nil, fmt.Errorf("%w: %s has no role", ErrInvalidToken, client.Name)
+	}
+	if allOrgs {
+		client.Orgs = nil
+	}
+	return client, nil
+}
+
+// verify checks the signature, issuer, audience and lifetime of a JWT and
+// returns its claims
+func (v *Verifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the issuer, audience, expiry and not-before time
+func (v *Verifier) checkClaims(claims map[string]interface{}) error {
+	if issuer, _ := claims["iss"].(string); issuer != v.config.Issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, issuer)
+	}
+
+	audienceOK := false
+	for _, audience := range stringList(claims["aud"]) {
+		if audience == v.config.Audience {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	now := time.Now()
+	expiry, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(expiry), 0)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(notBefore), 0)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	return nil
+}
+
+// key returns the public key with an ID. The key set is reloaded once its
+// cache expires or for an unknown ID, at most once per jwksRefetchInterval.
+// The reload runs without holding mu; requests for a known key keep using
+// the cached set meanwhile, requests for an unknown one wait for it.
+func (v *Verifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, err := v.cachedKey(kid)
+	stale := time.Since(v.fetched) > v.config.JWKSCacheTTL
+	if !stale && err == nil {
+		v.mu.Unlock()
+		return key, nil
+	}
+
+	if loading := v.loading; loading != nil {
+		v.mu.Unlock()
+		if err == nil {
+			return key, nil
+		}
+		<-loading
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return v.cachedKey(kid)
+	}
+
+	if time.Since(v.attempted) <= jwksRefetchInterval {
+		v.mu.Unlock()
+		return key, err
+	}
+	v.attempted = time.Now()
+	loading := make(chan struct{})
+	v.loading = loading
+	v.mu.Unlock()
+
+	keys, loadErr := v.loadKeys()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.loading = nil
+	close(loading)
+	if loadErr != nil {
+		// Keep verifying with the last key set while the provider is unreachable
+		log.Warn().Err(loadErr).Msg("Failed to reload JWKS, using cached keys")
+		return key, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+	log.Debug().Int("keys", len(keys)).Msg("JWKS reloaded")
+	return v.cachedKey(kid)
+}
+
+// cachedKey looks up a key in the loaded key set. A token without a key ID
+// can only be verified against a set holding a single key.
+func (v *Verifier) cachedKey(kid string) (crypto.PublicKey, error) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// loadKeys reads the key set from its file or URL
+func (v *Verifier) loadKeys() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	if v.config.JWKSFile != "" {
+		var err error
+		data, err = os.ReadFile(v.config.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading jwks file: %v", err)
+		}
+	} else {
+		resp, err := v.http.Get(v.config.JWKSURL)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching jwks: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("error fetching jwks: status %d", resp.StatusCode)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return nil, fmt.Errorf("error fetching jwks: %v", err)
+		}
+	}
+	return parseJWKS(data)
+}
+
+// jwk is a single JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the RSA and EC signing keys of a JSON Web Key Set; keys of
+// other types are skipped
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing jwks: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing jwks key %q: %v", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("error parsing jwks: no signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey decodes a key, or returns nil for an unsupported key type
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+// verifySignature checks a JWT signature. Only asymmetric algorithms are
+// accepted, so a token cannot be signed with the public key as an HMAC secret.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256([]byte(signed))
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384([]byte(signed))
+		digest = sum[:]
+	default:
+		sum := sha512.Sum512([]byte(signed))
+		digest = sum[:]
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' || rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key", ErrInvalidToken)
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+	}
+	return nil
+}
+
+// decodeInt decodes a base64url big-endian integer
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("malformed integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// stringList reads a claim that is a string or a list of strings
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
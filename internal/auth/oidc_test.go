@@ -0,0 +1,521 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "copilot-invite"
+)
+
+// testKeys are the signing keys of a fake identity provider
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+var (
+	keysOnce   sync.Once
+	sharedKeys testKeys
+)
+
+// newTestKeys returns an RSA and an EC key, generated once per test run
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	keysOnce.Do(func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("generating RSA key: %v", err)
+		}
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generating EC key: %v", err)
+		}
+		sharedKeys = testKeys{rsa: rsaKey, ec: ecKey}
+	})
+	return sharedKeys
+}
+
+// jwks returns the public keys as a JSON Web Key Set, the RSA key as
+// "rsa-1" and the EC key as "ec-1"
+func (k testKeys) jwks() []byte {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa-1",
+				"use": "sig",
+				"n":   encode(k.rsa.N),
+				"e":   encode(big.NewInt(int64(k.rsa.E))),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec-1",
+				"crv": "P-256",
+				"x":   encode(k.ec.X),
+				"y":   encode(k.ec.Y),
+			},
+			{
+				"kty": "oct",
+				"kid": "hmac-1",
+				"k":   "c2VjcmV0",
+			},
+		},
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// sign returns a JWT with the given header and claims, signed with key for
+// the RS256 and ES256 algorithms and left unsigned otherwise
+func sign(t *testing.T, header, claims map[string]interface{}, key crypto.Signer) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("encoding segment: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(header) + "." + segment(claims)
+	if key == nil {
+		return signed + "."
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims returns the claims of a token the test verifier accepts
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            testIssuer,
+		"aud":            testAudience,
+		"sub":            "00u1abcd",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"groups":         []string{"copilot-admins"},
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+// newTestVerifier returns a verifier reading the key set from a file
+func newTestVerifier(t *testing.T, keys testKeys) *Verifier {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, keys.jwks(), 0600); err != nil {
+		t.Fatalf("writing jwks: %v", err)
+	}
+	v, err := NewVerifier(OIDCConfig{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKSFile: file,
+		Roles: []OIDCRole{
+			{Name: "admins", Groups: []string{"copilot-admins"}, Scopes: []string{ScopeCopilotInvite, ScopeOrgsRead}, Orgs: []string{"acme"}},
+			{Name: "auditor", Emails: []string{"bob@example.com"}, Scopes: []string{ScopeOrgsRead}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return v
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	tests := []struct {
+		name string
+		kid  string
+		alg  string
+		key  crypto.Signer
+	}{
+		{name: "RS256", kid: "rsa-1", alg: "RS256", key: keys.rsa},
+		{name: "ES256", kid: "ec-1", alg: "ES256", key: keys.ec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := sign(t, map[string]interface{}{"alg": tt.alg, "kid": tt.kid, "typ": "JWT"}, validClaims(), tt.key)
+			client, err := v.Authenticate(token)
+			if err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+			if client.Name != "alice@example.com" {
+				t.Errorf("name = %q, want alice@example.com", client.Name)
+			}
+			if !client.HasScope(ScopeCopilotInvite) || len(client.Orgs) != 1 || client.Orgs[0] != "acme" {
+				t.Errorf("client = %+v, want the admins role", client)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRoleByEmail(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	claims := validClaims()
+	claims["email"] = "Bob@example.com"
+	claims["groups"] = []string{}
+	client, err := v.Authenticate(sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if client.HasScope(ScopeCopilotInvite) || !client.HasScope(ScopeOrgsRead) || client.Orgs != nil {
+		t.Errorf("client = %+v, want read access to every organization", client)
+	}
+}
+
+func TestAuthenticateUnverifiedEmail(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	// An unverified email does not match a role by email
+	claims := validClaims()
+	claims["email"] = "bob@example.com"
+	claims["groups"] = []string{}
+	for _, verified := range []interface{}{false, "true", nil} {
+		if verified == nil {
+			delete(claims, "email_verified")
+		} else {
+			claims["email_verified"] = verified
+		}
+		if _, err := v.Authenticate(sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("email_verified %v: err = %v, want ErrInvalidToken", verified, err)
+		}
+	}
+
+	// Nor does it name a user who matches a role by group
+	claims = validClaims()
+	claims["email_verified"] = false
+	client, err := v.Authenticate(sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if client.Name != "oidc:00u1abcd" {
+		t.Errorf("name = %q, want oidc:00u1abcd", client.Name)
+	}
+}
+
+func TestAuthenticateRejects(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	// An HS256 token whose secret is the RSA public key, the classic
+	// algorithm confusion attack
+	hmacToken := func(t *testing.T) string {
+		secret, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+		if err != nil {
+			t.Fatalf("encoding public key: %v", err)
+		}
+		unsigned := sign(t, map[string]interface{}{"alg": "HS256", "kid": "rsa-1"}, validClaims(), nil)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(unsigned[:len(unsigned)-1]))
+		return unsigned + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	withClaim := func(name string, value interface{}) func(*testing.T) string {
+		return func(t *testing.T) string {
+			claims := validClaims()
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+			return sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token func(*testing.T) string
+	}{
+		{"alg none", func(t *testing.T) string {
+			return sign(t, map[string]interface{}{"alg": "none", "kid": "rsa-1"}, validClaims(), nil)
+		}},
+		{"HS256 with the public key as secret", hmacToken},
+		{"HS256 with an oct key", func(t *testing.T) string {
+			unsigned := sign(t, map[string]interface{}{"alg": "HS256", "kid": "hmac-1"}, validClaims(), nil)
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(unsigned[:len(unsigned)-1]))
+			return unsigned + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}},
+		{"ES256 signature on an RSA key", func(t *testing.T) string {
+			return sign(t, map[string]interface{}{"alg": "ES256", "kid": "rsa-1"}, validClaims(), keys.ec)
+		}},
+		{"RS256 header on an EC key", func(t *testing.T) string {
+			return sign(t, map[string]interface{}{"alg": "RS256", "kid": "ec-1"}, validClaims(), keys.rsa)
+		}},
+		{"tampered claims", func(t *testing.T) string {
+			token := sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, validClaims(), keys.rsa)
+			claims := validClaims()
+			claims["email"] = "mallory@example.com"
+			forged := sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, nil)
+			return forged + token[strings.LastIndex(token, ".")+1:]
+		}},
+		{"unknown kid", func(t *testing.T) string {
+			return sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-2"}, validClaims(), keys.rsa)
+		}},
+		{"expired", withClaim("exp", time.Now().Add(-2*clockSkew).Unix())},
+		{"no expiry", withClaim("exp", nil)},
+		{"not valid yet", withClaim("nbf", time.Now().Add(2*clockSkew).Unix())},
+		{"wrong issuer", withClaim("iss", "https://evil.example.com")},
+		{"wrong audience", withClaim("aud", "another-app")},
+		{"no role", func(t *testing.T) string {
+			claims := validClaims()
+			claims["groups"] = []string{"engineering"}
+			return sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa)
+		}},
+		{"not a JWT", func(*testing.T) string { return "not-a-jwt" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if client, err := v.Authenticate(tt.token(t)); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Authenticate = %+v, %v, want ErrInvalidToken", client, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAudienceList(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	claims := validClaims()
+	claims["aud"] = []string{"another-app", testAudience}
+	if _, err := v.Authenticate(sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa)); err != nil {
+		t.Errorf("Authenticate: %v", err)
+	}
+}
+
+func TestJWKSURLRotation(t *testing.T) {
+	keys := newTestKeys(t)
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+
+	var mu sync.Mutex
+	jwks := keys.jwks()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	v, err := NewVerifier(OIDCConfig{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKSURL:  server.URL,
+		Roles:    []OIDCRole{{Name: "admins", Groups: []string{"copilot-admins"}, Scopes: []string{ScopeOrgsRead}}},
+	})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+
+	// The provider rotates to a new key
+	mu.Lock()
+	jwks = testKeys{rsa: rotated, ec: keys.ec}.jwks()
+	mu.Unlock()
+	token := sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, validClaims(), rotated)
+
+	// Within the refetch interval the cached key set is used
+	if _, err := v.Authenticate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("err = %v, want ErrInvalidToken before the key set is reloaded", err)
+	}
+
+	v.mu.Lock()
+	v.attempted = time.Time{}
+	v.fetched = time.Time{}
+	v.mu.Unlock()
+	if _, err := v.Authenticate(token); err != nil {
+		t.Errorf("Authenticate after the key set was reloaded: %v", err)
+	}
+}
+
+func TestJWKSReloadOutsideLock(t *testing.T) {
+	keys := newTestKeys(t)
+
+	// The provider starts out with the RSA key under another ID
+	var mu sync.Mutex
+	fetches := 0
+	jwks := []byte(strings.Replace(string(keys.jwks()), `"rsa-1"`, `"rsa-0"`, 1))
+	var block chan struct{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		wait, data := block, jwks
+		mu.Unlock()
+		if wait != nil {
+			<-wait
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	v, err := NewVerifier(OIDCConfig{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKSURL:  server.URL,
+		Roles:    []OIDCRole{{Name: "admins", Groups: []string{"copilot-admins"}, Scopes: []string{ScopeOrgsRead}}},
+	})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+
+	// The provider adds a key and answers slowly
+	release := make(chan struct{})
+	mu.Lock()
+	jwks = keys.jwks()
+	block = release
+	mu.Unlock()
+	v.mu.Lock()
+	v.attempted = time.Time{}
+	v.fetched = time.Time{}
+	v.mu.Unlock()
+
+	added := sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, validClaims(), keys.rsa)
+	known := sign(t, map[string]interface{}{"alg": "ES256", "kid": "ec-1"}, validClaims(), keys.ec)
+
+	// Requests naming an unknown key wait for the reload
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := v.Authenticate(added)
+			results <- err
+		}()
+	}
+	for {
+		v.mu.Lock()
+		loading := v.loading != nil
+		v.mu.Unlock()
+		if loading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A known key is verified with the cached set meanwhile
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.Authenticate(known)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Authenticate with a known key: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a known key waited for the key set reload")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Authenticate after the reload: %v", err)
+		}
+	}
+
+	// The reload is not repeated within the refetch interval
+	unknown := sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-9"}, validClaims(), keys.rsa)
+	if _, err := v.Authenticate(unknown); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("err = %v, want ErrInvalidToken for an unknown key", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Errorf("key set fetched %d times, want 2", fetches)
+	}
+}
+
+func TestNewVerifierRejectsConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config OIDCConfig
+	}{
+		{"no issuer", OIDCConfig{Audience: testAudience, JWKSFile: "jwks.json"}},
+		{"no key set", OIDCConfig{Issuer: testIssuer, Audience: testAudience}},
+		{"two key sets", OIDCConfig{Issuer: testIssuer, Audience: testAudience, JWKSFile: "jwks.json", JWKSURL: "https://idp.example.com/keys"}},
+		{"role without scopes", OIDCConfig{Issuer: testIssuer, Audience: testAudience, JWKSFile: "jwks.json", Roles: []OIDCRole{{Name: "admins"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewVerifier(tt.config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAuthenticateSubjectWithoutEmail(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	// A subject named like an API client must not be taken for it
+	claims := validClaims()
+	delete(claims, "email")
+	claims["sub"] = "onboarding-portal"
+	client, err := v.Authenticate(sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if client.Name != "oidc:onboarding-portal" {
+		t.Errorf("name = %q, want oidc:onboarding-portal", client.Name)
+	}
+
+	// Neither is a name from an email claim that is not an address
+	claims["email"] = "onboarding-portal"
+	client, err = v.Authenticate(sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, keys.rsa))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if client.Name != "oidc:onboarding-portal" {
+		t.Errorf("name = %q, want oidc:onboarding-portal", client.Name)
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Scopes a client can be granted
+const (
+	ScopeOrgsRead      = "orgs:read"      // list organizations, teams, seats and billing
+	ScopeTeamsWrite    = "teams:write"    // create, change and delete teams and memberships
+	ScopeCopilotInvite = "copilot:invite" // assign seats, singly, in bulk or as jobs
+	ScopeCopilotRevoke = "copilot:revoke" // cancel seats
+	ScopeLicensesAdmin = "licenses:admin" // refresh the ledger, list reservations, reconcile
+	ScopeAll           = "*"
+)
+
+// Client is an API client allowed to call the service
+type Client struct {
+	Name      string   `mapstructure:"name" json:"name"`
+	TokenHash string   `mapstructure:"token_hash" json:"-"` // hex SHA-256 of the bearer token
+	Scopes    []string `mapstructure:"scopes" json:"scopes"`
+	Orgs      []string `mapstructure:"orgs" json:"orgs,omitempty"` // empty allows every organization
+	Groups    []string `mapstructure:"-" json:"groups,omitempty"`  // identity provider groups of a JWT user
+	// CertSubjects identify the client by a TLS client certificate whose
+	// subject common name or a DNS, URI or email SAN matches one of them
+	CertSubjects []string `mapstructure:"cert_subjects" json:"-"`
+}
+
+// HasScope reports whether the client was granted a scope
+func (c *Client) HasScope(scope string) bool {
+	for _, granted := range c.Scopes {
+		if granted == scope || granted == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOrg reports whether the client may act on an organization
+func (c *Client) AllowsOrg(org string) bool {
+	if len(c.Orgs) == 0 {
+		return true
+	}
+	for _, allowed := range c.Orgs {
+		if strings.EqualFold(allowed, org) {
+			return true
+		}
+	}
+	return false
+}
+
+// Registry holds the API clients, keyed by the hash of their token and by
+// their certificate subjects. Tokens themselves are never stored.
+type Registry struct {
+	clients []*Client
+	tokens  []*Client // clients with a token, in the order of hashes
+	hashes  [][]byte
+	certs   map[string]*Client
+}
+
+// NewRegistry creates a registry of clients and checks their definitions
+func NewRegistry(clients []Client) (*Registry, error) {
+	r := &Registry{certs: make(map[string]*Client)}
+	names := make(map[string]bool)
+	for i := range clients {
+		client := clients[i]
+		if client.Name == "" {
+			return nil, fmt.Errorf("api client %d has no name", i+1)
+		}
+		// Names of single sign-on users are emails or carry SubjectPrefix
+		if strings.Contains(client.Name, "@") || strings.HasPrefix(client.Name, SubjectPrefix) {
+			return nil, fmt.Errorf("api client name %s is reserved for single sign-on users, it must not contain @ or start with %s", client.Name, SubjectPrefix)
+		}
+		if names[client.Name] {
+			return nil, fmt.Errorf("api client %s is defined twice", client.Name)
+		}
+		names[client.Name] = true
+		r.clients = append(r.clients, &client)
+
+		if len(client.Scopes) == 0 {
+			return nil, fmt.Errorf("api client %s has no scopes", client.Name)
+		}
+		if client.TokenHash == "" && len(client.CertSubjects) == 0 {
+			return nil, fmt.Errorf("api client %s needs a token_hash or cert_subjects", client.Name)
+		}
+
+		for _, subject := range client.CertSubjects {
+			key := strings.ToLower(subject)
+			if other, exists := r.certs[key]; exists {
+				return nil, fmt.Errorf("certificate subject %s is used by api clients %s and %s", subject, other.Name, client.Name)
+			}
+			r.certs[key] = &client
+		}
+
+		if client.TokenHash == "" {
+			continue
+		}
+		hash, err := hex.DecodeString(client.TokenHash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("api client %s has an invalid token_hash, expected a hex SHA-256", client.Name)
+		}
+		r.tokens = append(r.tokens, &client)
+		r.hashes = append(r.hashes, hash)
+	}
+	return r, nil
+}
+
+// Authenticate returns the client a bearer token belongs to. Every hash is
+// compared in constant time.
+func (r *Registry) Authenticate(token string) (*Client, bool) {
+	hash := sha256.Sum256([]byte(token))
+	var found *Client
+	for i, candidate := range r.hashes {
+		if subtle.ConstantTimeCompare(hash[:], candidate) == 1 {
+			found = r.tokens[i]
+		}
+	}
+	return found, found != nil
+}
+
+// AuthenticateCertificate returns the client a verified TLS client
+// certificate belongs to, by its subject common name or SANs
+func (r *Registry) AuthenticateCertificate(cert *x509.Certificate) (*Client, bool) {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if client, ok := r.certs[strings.ToLower(name)]; ok {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+// Len returns the number of registered clients
+func (r *Registry) Len() int {
+	return len(r.clients)
+}
+
+// HashToken returns the token_hash to configure for a token
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,188 @@
+package authz
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Role is a set of actions granted to a subject
+type Role string
+
+const (
+	RoleViewer       Role = "viewer"
+	RoleTeamAdmin    Role = "team-admin"
+	RoleLicenseAdmin Role = "license-admin"
+	RoleSuperAdmin   Role = "super-admin"
+)
+
+// Action is something a subject may do in an organization
+type Action string
+
+const (
+	ActionRead           Action = "read"            // view organizations, teams, seats, billing and jobs
+	ActionManageTeams    Action = "manage-teams"    // create, change and delete teams and memberships
+	ActionAssignSeats    Action = "assign-seats"    // spend licenses on Copilot seats
+	ActionRevokeSeats    Action = "revoke-seats"    // cancel seats
+	ActionManageLicenses Action = "manage-licenses" // refresh the ledger, list reservations, reconcile
+	ActionManagePolicy   Action = "manage-policy"   // reload this policy
+)
+
+// roleActions lists the actions of every role
+var roleActions = map[Role][]Action{
+	RoleViewer:       {ActionRead},
+	RoleTeamAdmin:    {ActionRead, ActionManageTeams, ActionAssignSeats, ActionRevokeSeats},
+	RoleLicenseAdmin: {ActionRead, ActionAssignSeats, ActionRevokeSeats, ActionManageLicenses},
+	RoleSuperAdmin:   {ActionRead, ActionManageTeams, ActionAssignSeats, ActionRevokeSeats, ActionManageLicenses, ActionManagePolicy},
+}
+
+// AllOrgs binds a role in every organization
+const AllOrgs = "*"
+
+// Binding grants a role to subjects in some organizations, or only for some
+// teams of them. A binding restricted to teams still lets its subjects read
+// the whole organization.
+type Binding struct {
+	Role     Role     `mapstructure:"role"`
+	Subjects []string `mapstructure:"subjects"` // API client names, user emails or "oidc:" subjects
+	Groups   []string `mapstructure:"groups"`   // identity provider groups
+	Orgs     []string `mapstructure:"orgs"`     // "*" for every organization
+	Teams    []string `mapstructure:"teams"`    // team slugs, empty for the whole organization
+}
+
+// Subject is the caller an access decision is made for
+type Subject struct {
+	Name   string
+	Groups []string
+}
+
+// matches reports whether a binding applies to a subject
+func (b *Binding) matches(subject Subject) bool {
+	for _, name := range b.Subjects {
+		if strings.EqualFold(name, subject.Name) {
+			return true
+		}
+	}
+	for _, group := range b.Groups {
+		for _, member := range subject.Groups {
+			if group == member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// grants reports whether a binding allows an action on an organization and
+// team. Actions that are not tied to an organization need a binding for
+// every organization.
+func (b *Binding) grants(action Action, org, team string) bool {
+	if !contains(roleActions[b.Role], action) {
+		return false
+	}
+	if !containsFold(b.Orgs, AllOrgs) && (org == "" || !containsFold(b.Orgs, org)) {
+		return false
+	}
+	if len(b.Teams) == 0 || action == ActionRead {
+		return true
+	}
+	return team != "" && containsFold(b.Teams, team)
+}
+
+// Policy is a checked set of role bindings
+type Policy struct {
+	bindings []Binding
+}
+
+// NewPolicy creates a policy and checks its bindings
+func NewPolicy(bindings []Binding) (*Policy, error) {
+	for i, binding := range bindings {
+		if _, ok := roleActions[binding.Role]; !ok {
+			return nil, fmt.Errorf("role binding %d has unknown role %q", i+1, binding.Role)
+		}
+		if len(binding.Subjects) == 0 && len(binding.Groups) == 0 {
+			return nil, fmt.Errorf("role binding %d has no subjects or groups", i+1)
+		}
+		if len(binding.Orgs) == 0 {
+			return nil, fmt.Errorf("role binding %d has no orgs, use \"*\" for every organization", i+1)
+		}
+		if len(binding.Teams) > 0 && containsFold(binding.Orgs, AllOrgs) {
+			return nil, fmt.Errorf("role binding %d restricts teams in every organization, name the organizations", i+1)
+		}
+	}
+	return &Policy{bindings: bindings}, nil
+}
+
+// Allows reports whether any binding of a subject allows an action on an
+// organization and, for team actions, a team
+func (p *Policy) Allows(subject Subject, action Action, org, team string) bool {
+	for i := range p.bindings {
+		binding := &p.bindings[i]
+		if binding.matches(subject) && binding.grants(action, org, team) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorizer evaluates the current policy. The policy can be reloaded while
+// requests are being served.
+type Authorizer struct {
+	load func() (*Policy, error)
+
+	mu     sync.RWMutex
+	policy *Policy
+}
+
+// NewAuthorizer creates an authorizer with the policy returned by load,
+// which is called again on every reload
+func NewAuthorizer(load func() (*Policy, error)) (*Authorizer, error) {
+	policy, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &Authorizer{load: load, policy: policy}, nil
+}
+
+// Reload replaces the policy. The current policy is kept if the new one
+// cannot be loaded.
+func (a *Authorizer) Reload() error {
+	policy, err := a.load()
+	if err != nil {
+		return fmt.Errorf("error reloading access policy: %v", err)
+	}
+
+	a.mu.Lock()
+	a.policy = policy
+	a.mu.Unlock()
+
+	log.Info().Int("bindings", len(policy.bindings)).Msg("Access policy reloaded")
+	return nil
+}
+
+// Allows reports whether the current policy allows an action
+func (a *Authorizer) Allows(subject Subject, action Action, org, team string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.policy.Allows(subject, action, org, team)
+}
+
+func contains(actions []Action, action Action) bool {
+	for _, candidate := range actions {
+		if candidate == action {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
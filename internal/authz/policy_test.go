@@ -0,0 +1,150 @@
+package authz
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestPolicy(t *testing.T, bindings ...Binding) *Policy {
+	t.Helper()
+	policy, err := NewPolicy(bindings)
+	if err != nil {
+		t.Fatalf("NewPolicy: %v", err)
+	}
+	return policy
+}
+
+func TestPolicyAllows(t *testing.T) {
+	policy := newTestPolicy(t,
+		Binding{Role: RoleTeamAdmin, Subjects: []string{"alice@example.com"}, Orgs: []string{"acme"}, Teams: []string{"platform"}},
+		Binding{Role: RoleViewer, Groups: []string{"auditors"}, Orgs: []string{AllOrgs}},
+		Binding{Role: RoleLicenseAdmin, Subjects: []string{"billing-bot"}, Orgs: []string{"Acme", "globex"}},
+		Binding{Role: RoleSuperAdmin, Subjects: []string{"oidc:admin"}, Orgs: []string{AllOrgs}},
+	)
+
+	alice := Subject{Name: "Alice@Example.com"}
+	auditor := Subject{Name: "carol@example.com", Groups: []string{"auditors"}}
+	bot := Subject{Name: "billing-bot"}
+	admin := Subject{Name: "oidc:admin"}
+
+	tests := []struct {
+		name    string
+		subject Subject
+		action  Action
+		org     string
+		team    string
+		want    bool
+	}{
+		{"subject names match case-insensitively", alice, ActionManageTeams, "acme", "platform", true},
+		{"team binding limits team actions", alice, ActionManageTeams, "acme", "web", false},
+		{"team binding needs a team", alice, ActionAssignSeats, "acme", "", false},
+		{"team binding reads the whole organization", alice, ActionRead, "acme", "", true},
+		{"binding is limited to its organizations", alice, ActionRead, "globex", "", false},
+		{"action outside the role", alice, ActionManageLicenses, "acme", "", false},
+		{"group binding in every organization", auditor, ActionRead, "initech", "", true},
+		{"viewer cannot assign", auditor, ActionAssignSeats, "initech", "", false},
+		{"organization names match case-insensitively", bot, ActionManageLicenses, "ACME", "", true},
+		{"action not tied to an organization needs every organization", bot, ActionManageLicenses, "", "", false},
+		{"super-admin without an organization", admin, ActionManagePolicy, "", "", true},
+		{"group names match exactly", Subject{Name: "dave", Groups: []string{"Auditors"}}, ActionRead, "acme", "", false},
+		{"unknown subject is denied", Subject{Name: "mallory"}, ActionRead, "acme", "", false},
+		{"subject without a name is denied", Subject{}, ActionRead, "acme", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Allows(tt.subject, tt.action, tt.org, tt.team); got != tt.want {
+				t.Errorf("Allows(%+v, %s, %q, %q) = %v, want %v", tt.subject, tt.action, tt.org, tt.team, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyPolicyDeniesAll(t *testing.T) {
+	policy := newTestPolicy(t)
+	for _, action := range []Action{ActionRead, ActionManageTeams, ActionAssignSeats, ActionRevokeSeats, ActionManageLicenses, ActionManagePolicy} {
+		if policy.Allows(Subject{Name: "alice@example.com", Groups: []string{"admins"}}, action, "acme", "platform") {
+			t.Errorf("empty policy allows %s", action)
+		}
+	}
+}
+
+func TestNewPolicyRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		binding Binding
+	}{
+		{"unknown role", Binding{Role: "owner", Subjects: []string{"alice"}, Orgs: []string{"acme"}}},
+		{"no subjects or groups", Binding{Role: RoleViewer, Orgs: []string{"acme"}}},
+		{"no orgs", Binding{Role: RoleViewer, Subjects: []string{"alice"}}},
+		{"teams in every organization", Binding{Role: RoleTeamAdmin, Subjects: []string{"alice"}, Orgs: []string{AllOrgs}, Teams: []string{"platform"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPolicy([]Binding{tt.binding}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAuthorizerReload(t *testing.T) {
+	alice := Subject{Name: "alice@example.com"}
+	viewer := Binding{Role: RoleViewer, Subjects: []string{"alice@example.com"}, Orgs: []string{"acme"}}
+	admin := Binding{Role: RoleTeamAdmin, Subjects: []string{"alice@example.com"}, Orgs: []string{"acme"}}
+
+	// load returns the next policy, or fails if there is none
+	var next []Binding
+	var loadErr error
+	load := func() (*Policy, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return NewPolicy(next)
+	}
+
+	next = []Binding{viewer}
+	a, err := NewAuthorizer(load)
+	if err != nil {
+		t.Fatalf("NewAuthorizer: %v", err)
+	}
+	if a.Allows(alice, ActionManageTeams, "acme", "platform") {
+		t.Fatal("viewer may manage teams")
+	}
+
+	next = []Binding{admin}
+	if err := a.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if !a.Allows(alice, ActionManageTeams, "acme", "platform") {
+		t.Error("reloaded binding is not applied")
+	}
+
+	// A policy that fails to load or check leaves the current one in place
+	loadErr = errors.New("config unreadable")
+	if err := a.Reload(); err == nil {
+		t.Error("expected the load error")
+	}
+	loadErr = nil
+	next = []Binding{{Role: "owner", Subjects: []string{"alice@example.com"}, Orgs: []string{"acme"}}}
+	if err := a.Reload(); err == nil {
+		t.Error("expected the invalid binding to be rejected")
+	}
+	if !a.Allows(alice, ActionManageTeams, "acme", "platform") {
+		t.Error("a failed reload replaced the policy")
+	}
+
+	// An empty policy denies everything
+	next = nil
+	if err := a.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if a.Allows(alice, ActionRead, "acme", "") {
+		t.Error("reloading an empty policy kept the old bindings")
+	}
+}
+
+func TestNewAuthorizerLoadError(t *testing.T) {
+	if _, err := NewAuthorizer(func() (*Policy, error) { return nil, errors.New("config unreadable") }); err == nil {
+		t.Error("expected the load error")
+	}
+}
@@ -44,6 +44,7 @@ func (m *Manager) Load() error {
 	modified := false
 	sensitiveKeys := []string{
 		"github.token",
+		"github.app.private_key",
 		"smartsheet.token",
 		"api.token",
 	}
@@ -51,8 +52,7 @@ func (m *Manager) Load() error {
 	// Process each sensitive key
 	for _, key := range sensitiveKeys {
 		parts := strings.Split(key, ".")
-		if value := getNestedValue(settings, parts...); value != "" {
-			strValue := value.(string)
+		if strValue, ok := getNestedValue(settings, parts...).(string); ok && strValue != "" {
 			if !encryption.IsEncrypted(strValue) {
 				// Encrypt the value
 				encrypted, err := m.encryptionMgr.Encrypt(strValue)
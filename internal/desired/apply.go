@@ -0,0 +1,151 @@
+package desired
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github-copilot-invite/internal/invite"
+
+	gh "github.com/google/go-github/v60/github"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrInsufficientLicenses is returned when a plan grants more seats than an
+// organization has licenses for. Nothing is applied in that case.
+var ErrInsufficientLicenses = errors.New("not enough licenses to apply the plan")
+
+// Apply computes the plan for a document and carries it out, team changes
+// first, then revocations, then grants. A change that fails does not stop
+// the others; changes that depend on a team that could not be created are
+// skipped. Every change reports its status.
+func (p *Planner) Apply(doc *Document) (*Plan, error) {
+	plan, err := p.Plan(doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, check := range plan.Licenses {
+		if !check.Sufficient {
+			return plan, ErrInsufficientLicenses
+		}
+	}
+	plan.Applied = true
+
+	// Teams created by the plan, by organization and lower-case name
+	created := make(map[string]*gh.Team)
+	failed := make(map[string]bool)
+	teamKey := func(change *Change) string {
+		return change.Organization + "/" + strings.ToLower(change.Team)
+	}
+	slug := func(change *Change) string {
+		if team, ok := created[teamKey(change)]; ok {
+			return team.GetSlug()
+		}
+		return change.Team
+	}
+
+	var grants []*Change
+	for _, change := range plan.Changes {
+		if change.Team != "" && failed[teamKey(change)] {
+			change.Status = StatusSkipped
+			change.Error = fmt.Sprintf("team %s was not created", change.Team)
+			continue
+		}
+
+		var err error
+		switch change.Action {
+		case ActionCreateTeam:
+			err = p.createTeam(change, created)
+			if err != nil {
+				failed[teamKey(change)] = true
+			}
+		case ActionAddMember, ActionUpdateMember:
+			_, err = p.githubClient.EnsureTeamMembership(change.Organization, slug(change), change.Username, change.Role)
+		case ActionRemoveMember:
+			err = p.githubClient.RemoveTeamMembership(change.Organization, slug(change), change.Username)
+		case ActionRevokeSeat:
+			err = p.revokeSeat(change)
+		case ActionGrantSeat:
+			grants = append(grants, change)
+			continue
+		}
+		change.finish(err)
+	}
+
+	// Grant the seats as one batch, so each organization's licenses are
+	// reserved up front
+	if len(grants) > 0 {
+		reqs := make([]invite.Request, len(grants))
+		for i, change := range grants {
+			reqs[i] = invite.Request{
+				Organization: change.Organization,
+				Team:         slug(change),
+				Username:     change.Username,
+				Role:         change.Role,
+			}
+		}
+		for i, result := range p.invites.InviteBatch(reqs) {
+			if result.Status == invite.StatusAssigned || result.Status == invite.StatusAlreadyHasSeat {
+				grants[i].Status = StatusApplied
+				continue
+			}
+			grants[i].Status = StatusFailed
+			grants[i].Error = fmt.Sprintf("%s: %s", result.Status, result.Error)
+		}
+	}
+
+	log.Info().Int("changes", len(plan.Changes)).Msg("Desired state applied")
+	return plan, nil
+}
+
+// createTeam creates a declared team, under its parent if it has one
+func (p *Planner) createTeam(change *Change, created map[string]*gh.Team) error {
+	newTeam := &gh.NewTeam{Name: change.spec.Name}
+	if change.spec.Description != "" {
+		newTeam.Description = &change.spec.Description
+	}
+	if change.spec.Privacy != "" {
+		newTeam.Privacy = &change.spec.Privacy
+	}
+	newTeam.ParentTeamID = change.parentID
+	if change.spec.Parent != "" && newTeam.ParentTeamID == nil {
+		parent, ok := created[change.Organization+"/"+strings.ToLower(change.spec.Parent)]
+		if !ok {
+			return fmt.Errorf("parent team %s was not created", change.spec.Parent)
+		}
+		newTeam.ParentTeamID = parent.ID
+	}
+
+	team, err := p.githubClient.CreateTeam(change.Organization, newTeam)
+	if err != nil {
+		return err
+	}
+	created[change.Organization+"/"+strings.ToLower(change.Team)] = team
+	return nil
+}
+
+// revokeSeat cancels a seat and returns its license
+func (p *Planner) revokeSeat(change *Change) error {
+	cancellation, err := p.githubClient.RevokeCopilotSeat(change.Organization, change.Username)
+	if err != nil {
+		return err
+	}
+	return p.licenses.Return(change.Organization, cancellation.SeatsCancelled)
+}
+
+// finish records the outcome of a change
+func (c *Change) finish(err error) {
+	if err != nil {
+		c.Status = StatusFailed
+		c.Error = err.Error()
+		log.Error().
+			Err(err).
+			Str("action", string(c.Action)).
+			Str("org", c.Organization).
+			Str("team", c.Team).
+			Str("username", c.Username).
+			Msg("Failed to apply change")
+		return
+	}
+	c.Status = StatusApplied
+}
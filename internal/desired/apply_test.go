@@ -0,0 +1,103 @@
+package desired
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	gh := liveAcme()
+	p, backend := newTestPlanner(t, gh, 5)
+
+	doc := parse(t, strings.Replace(pilotDoc, "- name: acme", "- name: acme\n    exclusive: true", 1))
+	plan, err := p.Apply(doc)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if !plan.Applied {
+		t.Error("plan is not marked applied")
+	}
+	for _, change := range plan.Changes {
+		if change.Status != StatusApplied {
+			t.Errorf("%s %s: status %s (%s), want applied", change.Action, change.Username, change.Status, change.Error)
+		}
+	}
+
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	if _, held := gh.seats["bob"]; !held {
+		t.Error("bob was not granted a seat")
+	}
+	if _, held := gh.seats["zed"]; held {
+		t.Error("zed's direct seat was not revoked")
+	}
+	if _, held := gh.seats["yan"]; !held {
+		t.Error("a seat assigned through a team was revoked")
+	}
+	if gh.members["pilot"]["carol"] || !gh.members["pilot"]["alice"] {
+		t.Errorf("pilot members = %v, want alice kept and carol removed", gh.members["pilot"])
+	}
+	// One license spent on bob, one returned by zed
+	if got, _ := backend.Available("acme"); got != 5 {
+		t.Errorf("available = %d, want 5", got)
+	}
+}
+
+func TestApplyCreatesNestedTeams(t *testing.T) {
+	gh := newFakeGitHub("bob")
+	gh.addTeam("platform")
+	p, backend := newTestPlanner(t, gh, 1)
+
+	plan, err := p.Apply(parse(t, `
+organizations:
+  - name: acme
+    teams:
+      - name: wave-1
+        parent: platform
+      - name: wave-2
+        parent: wave-1
+        copilot: true
+        members: [bob]
+`))
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	for _, change := range plan.Changes {
+		if change.Status != StatusApplied {
+			t.Errorf("%s %s: status %s (%s), want applied", change.Action, change.Team, change.Status, change.Error)
+		}
+	}
+
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	// wave-1 under platform (id 1), wave-2 under wave-1 (id 2)
+	if want := []string{"wave-1:1", "wave-2:2"}; !equal(gh.created, want) {
+		t.Errorf("created = %v, want %v", gh.created, want)
+	}
+	if _, isMember := gh.members["wave-2"]["bob"]; !isMember {
+		t.Error("bob was not added to the new team")
+	}
+	if got, _ := backend.Available("acme"); got != 0 {
+		t.Errorf("available = %d, want 0", got)
+	}
+}
+
+func TestApplyInsufficientLicenses(t *testing.T) {
+	gh := liveAcme()
+	p, _ := newTestPlanner(t, gh, 0)
+
+	plan, err := p.Apply(parse(t, pilotDoc))
+	if !errors.Is(err, ErrInsufficientLicenses) {
+		t.Fatalf("err = %v, want ErrInsufficientLicenses", err)
+	}
+	if plan.Applied {
+		t.Error("plan is marked applied")
+	}
+
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	if len(gh.memberships) != 0 || len(gh.revoked) != 0 {
+		t.Errorf("changes were made: memberships %v, revoked %v", gh.memberships, gh.revoked)
+	}
+}
@@ -0,0 +1,104 @@
+package desired
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Document describes the desired teams, members and Copilot seats of a set
+// of organizations. Members not listed for a declared team are removed from
+// it; teams that are not declared are left alone. Seats held by users who are
+// not in one of the Copilot teams are only revoked in exclusive
+// organizations.
+type Document struct {
+	Organizations []Organization `yaml:"organizations" json:"organizations"`
+}
+
+// Organization is the desired state of a single organization
+type Organization struct {
+	Name string `yaml:"name" json:"name"`
+	// Exclusive makes the Copilot teams the only way to hold a seat: seats
+	// assigned directly to anyone else are revoked
+	Exclusive bool   `yaml:"exclusive" json:"exclusive,omitempty"`
+	Teams     []Team `yaml:"teams" json:"teams"`
+}
+
+// Team is the desired state of a team, matched to GitHub by name
+type Team struct {
+	Name        string   `yaml:"name" json:"name"`
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Privacy     string   `yaml:"privacy" json:"privacy,omitempty"` // secret or closed
+	Parent      string   `yaml:"parent" json:"parent,omitempty"`   // name of the parent team
+	Copilot     bool     `yaml:"copilot" json:"copilot"`           // every member should hold a seat
+	Maintainers []string `yaml:"maintainers" json:"maintainers,omitempty"`
+	Members     []string `yaml:"members" json:"members,omitempty"`
+}
+
+// Parse reads a desired state document from YAML (or JSON) and checks it
+func Parse(r io.Reader) (*Document, error) {
+	var doc Document
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error parsing desired state: %v", err)
+	}
+	if err := doc.validate(); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// OrganizationNames lists the organizations the document manages
+func (d *Document) OrganizationNames() []string {
+	names := make([]string, len(d.Organizations))
+	for i, org := range d.Organizations {
+		names[i] = org.Name
+	}
+	return names
+}
+
+// validate checks that names are given and unique, and that a team's parent
+// is declared before it or already exists
+func (d *Document) validate() error {
+	if len(d.Organizations) == 0 {
+		return fmt.Errorf("desired state has no organizations")
+	}
+
+	orgs := make(map[string]bool)
+	for _, org := range d.Organizations {
+		if org.Name == "" {
+			return fmt.Errorf("organization without a name")
+		}
+		if orgs[strings.ToLower(org.Name)] {
+			return fmt.Errorf("organization %s is declared twice", org.Name)
+		}
+		orgs[strings.ToLower(org.Name)] = true
+
+		teams := make(map[string]bool)
+		for _, team := range org.Teams {
+			if team.Name == "" {
+				return fmt.Errorf("team without a name in organization %s", org.Name)
+			}
+			if teams[strings.ToLower(team.Name)] {
+				return fmt.Errorf("team %s is declared twice in organization %s", team.Name, org.Name)
+			}
+			teams[strings.ToLower(team.Name)] = true
+
+			if team.Privacy != "" && team.Privacy != "secret" && team.Privacy != "closed" {
+				return fmt.Errorf("team %s has invalid privacy %q, must be secret or closed", team.Name, team.Privacy)
+			}
+
+			users := make(map[string]bool)
+			for _, username := range append(append([]string{}, team.Maintainers...), team.Members...) {
+				if users[strings.ToLower(username)] {
+					return fmt.Errorf("user %s is listed twice in team %s", username, team.Name)
+				}
+				users[strings.ToLower(username)] = true
+			}
+		}
+	}
+	return nil
+}
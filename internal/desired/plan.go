@@ -0,0 +1,255 @@
+package desired
+
+import (
+	"fmt"
+	"strings"
+
+	"github-copilot-invite/internal/github"
+	"github-copilot-invite/internal/invite"
+	"github-copilot-invite/internal/license"
+)
+
+// Action is the kind of a planned change
+type Action string
+
+const (
+	ActionCreateTeam   Action = "create-team"
+	ActionAddMember    Action = "add-member"
+	ActionUpdateMember Action = "update-member"
+	ActionRemoveMember Action = "remove-member"
+	ActionGrantSeat    Action = "grant-seat"
+	ActionRevokeSeat   Action = "revoke-seat"
+)
+
+// Status is the outcome of a change once a plan is applied
+type Status string
+
+const (
+	StatusApplied Status = "applied"
+	StatusFailed  Status = "failed"
+	StatusSkipped Status = "skipped"
+)
+
+// Change is a single step of a plan. Team is the slug of an existing team or
+// the name of a team created by the plan.
+type Change struct {
+	Action       Action `json:"action"`
+	Organization string `json:"organization"`
+	Team         string `json:"team,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Role         string `json:"role,omitempty"`
+	Status       Status `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	spec     *Team  // declared team, for create-team
+	parentID *int64 // existing parent team, for create-team
+}
+
+// LicenseCheck compares the seats an organization's plan grants with its
+// available licenses
+type LicenseCheck struct {
+	Organization string `json:"organization"`
+	Required     int    `json:"required"`
+	Available    int    `json:"available"`
+	Sufficient   bool   `json:"sufficient"`
+}
+
+// Plan is the set of changes that brings GitHub in line with a document
+type Plan struct {
+	Changes  []*Change      `json:"changes"`
+	Licenses []LicenseCheck `json:"licenses"`
+	Warnings []string       `json:"warnings,omitempty"`
+	Applied  bool           `json:"applied"`
+}
+
+// Planner computes and applies plans against live GitHub state
+type Planner struct {
+	githubClient *github.Client
+	licenses     license.Store
+	invites      *invite.Service
+}
+
+// New creates a new planner. Seats are granted through the invite service,
+// so grants get the same eligibility and license checks as any invite.
+func New(githubClient *github.Client, licenses license.Store, invites *invite.Service) *Planner {
+	return &Planner{
+		githubClient: githubClient,
+		licenses:     licenses,
+		invites:      invites,
+	}
+}
+
+// Plan compares a document with the live state of its organizations. Nothing
+// is changed.
+func (p *Planner) Plan(doc *Document) (*Plan, error) {
+	plan := &Plan{Changes: []*Change{}}
+	for _, org := range doc.Organizations {
+		if err := p.planOrg(org, plan); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// member is a declared user of a team
+type member struct {
+	username string
+	role     string
+}
+
+// seatHolder is a user who should hold a seat, through one of their teams
+type seatHolder struct {
+	member
+	team string
+}
+
+// planOrg adds the changes of a single organization to the plan
+func (p *Planner) planOrg(org Organization, plan *Plan) error {
+	liveTeams, err := p.githubClient.ListTeams(org.Name)
+	if err != nil {
+		return err
+	}
+	teamsByName := make(map[string]int64)
+	slugs := make(map[string]string)
+	for _, team := range liveTeams {
+		teamsByName[strings.ToLower(team.GetName())] = team.GetID()
+		slugs[strings.ToLower(team.GetName())] = team.GetSlug()
+	}
+
+	var holders []seatHolder
+	wanted := make(map[string]bool)
+	declared := make(map[string]bool)
+
+	for i := range org.Teams {
+		team := &org.Teams[i]
+		key := strings.ToLower(team.Name)
+
+		ref, exists := slugs[key]
+		current := make(map[string]string)
+		var logins []string
+		if exists {
+			if current, logins, err = p.teamRoles(org.Name, ref); err != nil {
+				return err
+			}
+		} else {
+			ref = team.Name
+			create := &Change{Action: ActionCreateTeam, Organization: org.Name, Team: team.Name, spec: team}
+			if team.Parent != "" {
+				parent := strings.ToLower(team.Parent)
+				if id, ok := teamsByName[parent]; ok {
+					create.parentID = &id
+				} else if !declared[parent] {
+					return fmt.Errorf("parent team %s of team %s does not exist in organization %s", team.Parent, team.Name, org.Name)
+				}
+			}
+			plan.Changes = append(plan.Changes, create)
+		}
+		declared[key] = true
+
+		// Add the users that are missing and fix roles
+		desired := make(map[string]bool)
+		for _, user := range teamUsers(team) {
+			login := strings.ToLower(user.username)
+			desired[login] = true
+			switch role, isMember := current[login]; {
+			case !isMember:
+				plan.Changes = append(plan.Changes, &Change{Action: ActionAddMember, Organization: org.Name, Team: ref, Username: user.username, Role: user.role})
+			case role != user.role:
+				plan.Changes = append(plan.Changes, &Change{Action: ActionUpdateMember, Organization: org.Name, Team: ref, Username: user.username, Role: user.role})
+			}
+
+			if team.Copilot && !wanted[login] {
+				wanted[login] = true
+				holders = append(holders, seatHolder{member: user, team: ref})
+			}
+		}
+
+		// Remove the users that are not declared
+		for _, login := range logins {
+			if !desired[strings.ToLower(login)] {
+				plan.Changes = append(plan.Changes, &Change{Action: ActionRemoveMember, Organization: org.Name, Team: ref, Username: login})
+			}
+		}
+	}
+
+	// A seat that is pending cancellation is treated as gone: it is granted
+	// again if wanted and left to lapse otherwise. Other unwanted seats are
+	// only revoked when the organization is exclusive.
+	seats, err := p.githubClient.ListCopilotSeats(org.Name)
+	if err != nil {
+		return err
+	}
+	held := make(map[string]bool)
+	for _, seat := range seats {
+		if seat.PendingCancellationDate != "" {
+			continue
+		}
+		held[strings.ToLower(seat.Assignee)] = true
+
+		if wanted[strings.ToLower(seat.Assignee)] || !org.Exclusive {
+			continue
+		}
+		if seat.AssigningTeam != "" {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("seat of %s in %s is assigned through team %s and can only be revoked there", seat.Assignee, org.Name, seat.AssigningTeam))
+			continue
+		}
+		plan.Changes = append(plan.Changes, &Change{Action: ActionRevokeSeat, Organization: org.Name, Username: seat.Assignee})
+	}
+
+	required := 0
+	for _, holder := range holders {
+		if held[strings.ToLower(holder.username)] {
+			continue
+		}
+		plan.Changes = append(plan.Changes, &Change{Action: ActionGrantSeat, Organization: org.Name, Team: holder.team, Username: holder.username, Role: holder.role})
+		required++
+	}
+
+	available, err := p.licenses.Check(org.Name)
+	if err != nil {
+		return err
+	}
+	plan.Licenses = append(plan.Licenses, LicenseCheck{
+		Organization: org.Name,
+		Required:     required,
+		Available:    available,
+		Sufficient:   available >= required,
+	})
+	return nil
+}
+
+// teamRoles returns the role of every member of a live team by lower-case
+// login, and the logins as GitHub spells them
+func (p *Planner) teamRoles(org, slug string) (map[string]string, []string, error) {
+	members, err := p.githubClient.ListTeamMembers(org, slug)
+	if err != nil {
+		return nil, nil, err
+	}
+	maintainers, err := p.githubClient.ListTeamMaintainers(org, slug)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roles := make(map[string]string)
+	logins := make([]string, 0, len(members))
+	for _, user := range members {
+		roles[strings.ToLower(user.GetLogin())] = "member"
+		logins = append(logins, user.GetLogin())
+	}
+	for _, maintainer := range maintainers {
+		roles[strings.ToLower(maintainer.GetLogin())] = "maintainer"
+	}
+	return roles, logins, nil
+}
+
+// teamUsers lists the declared users of a team with their roles
+func teamUsers(team *Team) []member {
+	users := make([]member, 0, len(team.Maintainers)+len(team.Members))
+	for _, username := range team.Maintainers {
+		users = append(users, member{username: username, role: "maintainer"})
+	}
+	for _, username := range team.Members {
+		users = append(users, member{username: username, role: "member"})
+	}
+	return users
+}
@@ -0,0 +1,413 @@
+package desired
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github-copilot-invite/internal/github"
+	"github-copilot-invite/internal/invite"
+	"github-copilot-invite/internal/license"
+)
+
+// liveSeat is a Copilot seat held in the fake organization
+type liveSeat struct {
+	team    string // assigning team, empty for a direct seat
+	pending bool   // pending cancellation
+}
+
+// fakeGitHub is a local stand-in for the GitHub API of the acme
+// organization. Every known user is an active member of it.
+type fakeGitHub struct {
+	mu          sync.Mutex
+	users       map[string]bool
+	teams       map[string]int64           // slug -> id
+	members     map[string]map[string]bool // slug -> login -> maintainer
+	seats       map[string]liveSeat
+	created     []string // teams created, with their parent id
+	revoked     []string
+	memberships []string // memberships added or changed, as team/user:role
+}
+
+func newFakeGitHub(users ...string) *fakeGitHub {
+	f := &fakeGitHub{
+		users:   make(map[string]bool),
+		teams:   make(map[string]int64),
+		members: make(map[string]map[string]bool),
+		seats:   make(map[string]liveSeat),
+	}
+	for _, user := range users {
+		f.users[user] = true
+	}
+	return f
+}
+
+// addTeam adds a live team with its members; maintainers are prefixed with @
+func (f *fakeGitHub) addTeam(slug string, members ...string) {
+	f.teams[slug] = int64(len(f.teams) + 1)
+	f.members[slug] = make(map[string]bool)
+	for _, member := range members {
+		f.members[slug][strings.TrimPrefix(member, "@")] = strings.HasPrefix(member, "@")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+}
+
+func (f *fakeGitHub) handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			handler(w, r)
+		})
+	}
+
+	handle("GET /orgs/acme/teams", func(w http.ResponseWriter, r *http.Request) {
+		teams := []map[string]interface{}{}
+		for slug, id := range f.teams {
+			teams = append(teams, map[string]interface{}{"id": id, "name": slug, "slug": slug})
+		}
+		writeJSON(w, http.StatusOK, teams)
+	})
+	handle("POST /orgs/acme/teams", func(w http.ResponseWriter, r *http.Request) {
+		var team struct {
+			Name     string `json:"name"`
+			ParentID *int64 `json:"parent_team_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&team)
+		slug := strings.ToLower(team.Name)
+		f.addTeam(slug)
+		parent := int64(0)
+		if team.ParentID != nil {
+			parent = *team.ParentID
+		}
+		f.created = append(f.created, slug+":"+strconv.FormatInt(parent, 10))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"id": f.teams[slug], "name": team.Name, "slug": slug})
+	})
+	handle("GET /orgs/acme/teams/{team}/members", func(w http.ResponseWriter, r *http.Request) {
+		members, exists := f.members[r.PathValue("team")]
+		if !exists {
+			notFound(w)
+			return
+		}
+		users := []map[string]string{}
+		for login, maintainer := range members {
+			if r.URL.Query().Get("role") == "maintainer" && !maintainer {
+				continue
+			}
+			users = append(users, map[string]string{"login": login})
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i]["login"] < users[j]["login"] })
+		writeJSON(w, http.StatusOK, users)
+	})
+	handle("GET /orgs/acme/teams/{team}/memberships/{user}", func(w http.ResponseWriter, r *http.Request) {
+		maintainer, isMember := f.members[r.PathValue("team")][r.PathValue("user")]
+		if !isMember {
+			notFound(w)
+			return
+		}
+		role := "member"
+		if maintainer {
+			role = "maintainer"
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"role": role, "state": "active"})
+	})
+	handle("PUT /orgs/acme/teams/{team}/memberships/{user}", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Role string `json:"role"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		team, user := r.PathValue("team"), r.PathValue("user")
+		if _, exists := f.members[team]; !exists {
+			notFound(w)
+			return
+		}
+		if body.Role == "" {
+			body.Role = "member"
+		}
+		f.members[team][user] = body.Role == "maintainer"
+		f.memberships = append(f.memberships, team+"/"+user+":"+body.Role)
+		writeJSON(w, http.StatusOK, map[string]string{"role": body.Role, "state": "active"})
+	})
+	handle("DELETE /orgs/acme/teams/{team}/memberships/{user}", func(w http.ResponseWriter, r *http.Request) {
+		delete(f.members[r.PathValue("team")], r.PathValue("user"))
+		f.memberships = append(f.memberships, r.PathValue("team")+"/"+r.PathValue("user")+":removed")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handle("GET /orgs/acme/copilot/billing/seats", func(w http.ResponseWriter, r *http.Request) {
+		logins := make([]string, 0, len(f.seats))
+		for login := range f.seats {
+			logins = append(logins, login)
+		}
+		sort.Strings(logins)
+		seats := []map[string]interface{}{}
+		for _, login := range logins {
+			seat := map[string]interface{}{"assignee": map[string]string{"login": login, "type": "User"}}
+			if f.seats[login].team != "" {
+				seat["assigning_team"] = map[string]string{"slug": f.seats[login].team}
+			}
+			if f.seats[login].pending {
+				seat["pending_cancellation_date"] = "2026-11-01"
+			}
+			seats = append(seats, seat)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"total_seats": len(seats), "seats": seats})
+	})
+	handle("GET /orgs/acme/members/{user}/copilot", func(w http.ResponseWriter, r *http.Request) {
+		if _, exists := f.seats[r.PathValue("user")]; !exists {
+			notFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"assignee": map[string]string{"login": r.PathValue("user"), "type": "User"}})
+	})
+	handle("POST /orgs/acme/copilot/billing/selected_users", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			SelectedUsernames []string `json:"selected_usernames"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		created := 0
+		for _, user := range body.SelectedUsernames {
+			if _, exists := f.seats[user]; !exists {
+				created++
+			}
+			f.seats[user] = liveSeat{}
+		}
+		writeJSON(w, http.StatusCreated, map[string]int{"seats_created": created})
+	})
+	handle("DELETE /orgs/acme/copilot/billing/selected_users", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			SelectedUsernames []string `json:"selected_usernames"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		cancelled := 0
+		for _, user := range body.SelectedUsernames {
+			if _, exists := f.seats[user]; exists {
+				cancelled++
+				f.revoked = append(f.revoked, user)
+			}
+			delete(f.seats, user)
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"seats_cancelled": cancelled})
+	})
+	handle("GET /users/{user}", func(w http.ResponseWriter, r *http.Request) {
+		if !f.users[r.PathValue("user")] {
+			notFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"login": r.PathValue("user")})
+	})
+	handle("GET /orgs/acme/memberships/{user}", func(w http.ResponseWriter, r *http.Request) {
+		if !f.users[r.PathValue("user")] {
+			notFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"state": "active"})
+	})
+	return mux
+}
+
+// memBackend is an in-memory license backend
+type memBackend struct {
+	mu        sync.Mutex
+	available map[string]int
+}
+
+func (b *memBackend) List() ([]license.License, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var licenses []license.License
+	for org, available := range b.available {
+		licenses = append(licenses, license.License{Organization: org, Available: available})
+	}
+	return licenses, nil
+}
+
+func (b *memBackend) Available(org string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.available[org], nil
+}
+
+func (b *memBackend) Adjust(org string, delta int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.available[org]+delta < 0 {
+		return license.ErrNoLicenses
+	}
+	b.available[org] += delta
+	return nil
+}
+
+func (b *memBackend) SetAvailable(org string, available int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available[org] = available
+	return nil
+}
+
+func (b *memBackend) Refresh() error {
+	return nil
+}
+
+// newTestPlanner returns a planner over a fake GitHub with available
+// licenses for acme
+func newTestPlanner(t *testing.T, gh *fakeGitHub, available int) (*Planner, *memBackend) {
+	t.Helper()
+	server := httptest.NewServer(gh.handler())
+	t.Cleanup(server.Close)
+
+	client, err := github.NewClientWithBaseURL("test-token", server.URL)
+	if err != nil {
+		t.Fatalf("NewClientWithBaseURL: %v", err)
+	}
+	backend := &memBackend{available: map[string]int{"acme": available}}
+	ledger := license.NewLedger(backend, time.Minute)
+	return New(client, ledger, invite.NewService(client, ledger)), backend
+}
+
+func parse(t *testing.T, yaml string) *Document {
+	t.Helper()
+	doc, err := Parse(strings.NewReader(yaml))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return doc
+}
+
+// summary lists the changes of a plan as action:team:user
+func summary(plan *Plan) []string {
+	var changes []string
+	for _, change := range plan.Changes {
+		changes = append(changes, string(change.Action)+":"+change.Team+":"+change.Username)
+	}
+	return changes
+}
+
+func equal(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// liveAcme is an organization with a Copilot team, a direct seat outside of
+// it, a seat through an undeclared team and a seat being cancelled
+func liveAcme() *fakeGitHub {
+	gh := newFakeGitHub("alice", "bob", "carol", "zed")
+	gh.addTeam("pilot", "@alice", "carol")
+	gh.seats["alice"] = liveSeat{}
+	gh.seats["zed"] = liveSeat{}
+	gh.seats["yan"] = liveSeat{team: "research"}
+	gh.seats["xia"] = liveSeat{pending: true}
+	return gh
+}
+
+const pilotDoc = `
+organizations:
+  - name: acme
+    teams:
+      - name: pilot
+        copilot: true
+        maintainers: [alice]
+        members: [bob]
+`
+
+func TestPlanLeavesOtherSeats(t *testing.T) {
+	p, _ := newTestPlanner(t, liveAcme(), 5)
+
+	plan, err := p.Plan(parse(t, pilotDoc))
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	want := []string{"add-member:pilot:bob", "remove-member:pilot:carol", "grant-seat:pilot:bob"}
+	if got := summary(plan); !equal(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+	if len(plan.Warnings) != 0 {
+		t.Errorf("warnings = %v, want none without exclusive", plan.Warnings)
+	}
+	if want := (LicenseCheck{Organization: "acme", Required: 1, Available: 5, Sufficient: true}); len(plan.Licenses) != 1 || plan.Licenses[0] != want {
+		t.Errorf("licenses = %+v, want %+v", plan.Licenses, want)
+	}
+}
+
+func TestPlanExclusiveRevokesDirectSeats(t *testing.T) {
+	p, _ := newTestPlanner(t, liveAcme(), 5)
+
+	doc := parse(t, strings.Replace(pilotDoc, "- name: acme", "- name: acme\n    exclusive: true", 1))
+	plan, err := p.Plan(doc)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	want := []string{"add-member:pilot:bob", "remove-member:pilot:carol", "revoke-seat::zed", "grant-seat:pilot:bob"}
+	if got := summary(plan); !equal(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+	if len(plan.Warnings) != 1 || !strings.Contains(plan.Warnings[0], "research") {
+		t.Errorf("warnings = %v, want one for the seat through research", plan.Warnings)
+	}
+}
+
+func TestPlanTeams(t *testing.T) {
+	gh := newFakeGitHub("alice", "bob")
+	gh.addTeam("platform", "alice")
+	p, _ := newTestPlanner(t, gh, 0)
+
+	plan, err := p.Plan(parse(t, `
+organizations:
+  - name: acme
+    teams:
+      - name: platform
+        maintainers: [alice]
+      - name: wave-1
+        parent: platform
+        members: [bob]
+      - name: wave-2
+        parent: wave-1
+`))
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	want := []string{"update-member:platform:alice", "create-team:wave-1:", "add-member:wave-1:bob", "create-team:wave-2:"}
+	if got := summary(plan); !equal(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+	if check := plan.Licenses[0]; check.Required != 0 || !check.Sufficient {
+		t.Errorf("licenses = %+v, want none required", check)
+	}
+
+	_, err = p.Plan(parse(t, `
+organizations:
+  - name: acme
+    teams:
+      - name: wave-1
+        parent: missing
+`))
+	if err == nil {
+		t.Error("expected an error for a parent that does not exist")
+	}
+}
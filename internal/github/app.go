@@ -0,0 +1,290 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// appJWTLifetime is how long an app JWT is valid; GitHub allows at most 10 minutes
+	appJWTLifetime = 9 * time.Minute
+	// tokenRefreshMargin is how long before expiry an installation token is replaced
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// AppConfig holds the credentials of a GitHub App
+type AppConfig struct {
+	AppID      int64
+	PrivateKey string // PEM encoded RSA key
+	// Installations maps organizations to installation IDs. Organizations
+	// not listed are looked up through the API.
+	Installations map[string]int64
+	// DefaultOrg picks the installation for requests that are not scoped to
+	// an organization, such as user lookups. Required.
+	DefaultOrg string
+}
+
+// NewAppClient creates a client that authenticates as a GitHub App. Every
+// request uses the installation token of the organization it addresses;
+// tokens are minted on first use and replaced before they expire. An empty
+// baseURL uses api.github.com.
+func NewAppClient(app AppConfig, baseURL string) (*Client, error) {
+	if app.DefaultOrg == "" {
+		return nil, errors.New("error creating github app client: no default organization set")
+	}
+	key, err := parsePrivateKey(app.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	signer := &appJWTSource{appID: app.AppID, key: key}
+
+	// The app client authenticates with a JWT and mints installation tokens
+	appClient := github.NewClient(oauth2.NewClient(ctx, signer))
+	transport := &installationTransport{
+		app:           appClient,
+		base:          http.DefaultTransport,
+		installations: make(map[string]int64),
+		sources:       make(map[int64]oauth2.TokenSource),
+		defaultOrg:    strings.ToLower(app.DefaultOrg),
+	}
+	for org, id := range app.Installations {
+		transport.installations[strings.ToLower(org)] = id
+	}
+	client := github.NewClient(&http.Client{Transport: transport})
+
+	if baseURL != "" {
+		u, err := parseBaseURL(baseURL)
+		if err != nil {
+			return nil, err
+		}
+		appClient.BaseURL = u
+		client.BaseURL = u
+	}
+
+	return &Client{
+		client: client,
+		app:    appClient,
+		ctx:    ctx,
+	}, nil
+}
+
+// parsePrivateKey reads an RSA key in PKCS#1 or PKCS#8 PEM form
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("error parsing github app private key: no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing github app private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("error parsing github app private key: not an RSA key")
+	}
+	return key, nil
+}
+
+// appJWTSource mints the RS256 JWTs that authenticate as the app itself
+type appJWTSource struct {
+	appID int64
+	key   *rsa.PrivateKey
+}
+
+func (s *appJWTSource) Token() (*oauth2.Token, error) {
+	// Backdate the issue time to allow for clock drift
+	now := time.Now()
+	expiry := now.Add(appJWTLifetime)
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": expiry.Unix(),
+		"iss": strconv.FormatInt(s.appID, 10),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("error signing github app jwt: %v", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: unsigned + "." + base64.RawURLEncoding.EncodeToString(signature),
+		TokenType:   "Bearer",
+		Expiry:      expiry.Add(-time.Minute),
+	}, nil
+}
+
+// installationTransport authenticates each request with the installation
+// token of the organization it addresses
+type installationTransport struct {
+	app  *github.Client
+	base http.RoundTripper
+
+	defaultOrg string
+
+	mu            sync.Mutex
+	installations map[string]int64
+	sources       map[int64]oauth2.TokenSource
+}
+
+type orgContextKey struct{}
+
+// withOrg marks a request context with the organization it is for, for
+// requests whose path does not name one, such as GraphQL queries
+func withOrg(ctx context.Context, org string) context.Context {
+	return context.WithValue(ctx, orgContextKey{}, org)
+}
+
+func (t *installationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	source, err := t.tokenSource(req.Context(), requestOrg(req))
+	if err != nil {
+		return nil, err
+	}
+	token, err := source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// A RoundTripper must not modify the request it was given
+	authorized := req.Clone(req.Context())
+	token.SetAuthHeader(authorized)
+	return t.base.RoundTrip(authorized)
+}
+
+// requestOrg returns the organization a request is for, from its context or
+// from an /orgs/{org} path
+func requestOrg(req *http.Request) string {
+	if org, ok := req.Context().Value(orgContextKey{}).(string); ok {
+		return strings.ToLower(org)
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] == "orgs" {
+			return strings.ToLower(segments[i+1])
+		}
+	}
+	return ""
+}
+
+// tokenSource returns the cached token source of the installation for an
+// organization
+func (t *installationTransport) tokenSource(ctx context.Context, org string) (oauth2.TokenSource, error) {
+	if org == "" {
+		org = t.defaultOrg
+	}
+	id, err := t.installationID(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	source, exists := t.sources[id]
+	if !exists {
+		source = oauth2.ReuseTokenSource(nil, &installationTokenSource{app: t.app, id: id})
+		t.sources[id] = source
+	}
+	return source, nil
+}
+
+// installationID finds the installation for an organization. The lookup runs
+// without holding mu so a slow call does not hold up requests for other
+// organizations; concurrent first requests may look the same one up twice.
+func (t *installationTransport) installationID(ctx context.Context, org string) (int64, error) {
+	t.mu.Lock()
+	id, ok := t.installations[org]
+	t.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	installation, resp, err := t.app.Apps.FindOrganizationInstallation(ctx, org)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return 0, fmt.Errorf("github app is not installed in org %s", org)
+		}
+		return 0, fmt.Errorf("error finding github app installation for org %s: %v", org, err)
+	}
+	t.mu.Lock()
+	t.installations[org] = installation.GetID()
+	t.mu.Unlock()
+	return installation.GetID(), nil
+}
+
+// installationTokenSource mints installation access tokens
+type installationTokenSource struct {
+	app *github.Client
+	id  int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	token, _, err := s.app.Apps.CreateInstallationToken(context.Background(), s.id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token for github app installation %d: %v", s.id, err)
+	}
+
+	// Report an early expiry so the token is replaced while still valid
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "token",
+		Expiry:      token.GetExpiresAt().Add(-tokenRefreshMargin),
+	}, nil
+}
+
+// listInstalledOrganizations lists the organizations the app is installed in.
+// An installation token cannot list organizations the way a user can.
+func (c *Client) listInstalledOrganizations() ([]*github.Organization, error) {
+	opts := &github.ListOptions{
+		PerPage: 100,
+	}
+	var allOrgs []*github.Organization
+	for {
+		installations, resp, err := c.app.Apps.ListInstallations(c.ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error listing organizations: %v", err)
+		}
+		for _, installation := range installations {
+			account := installation.GetAccount()
+			if account.GetType() != "Organization" {
+				continue
+			}
+			allOrgs = append(allOrgs, &github.Organization{
+				Login:     account.Login,
+				ID:        account.ID,
+				NodeID:    account.NodeID,
+				AvatarURL: account.AvatarURL,
+				URL:       account.URL,
+			})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return allOrgs, nil
+}
@@ -0,0 +1,220 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAppKey returns an RSA key and its PKCS#1 PEM encoding
+func testAppKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return key, string(pem.EncodeToMemory(block))
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, pkcs1 := testAppKey(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	pkcs8 := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	for name, data := range map[string]string{"pkcs1": pkcs1, "pkcs8": pkcs8} {
+		parsed, err := parsePrivateKey(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !parsed.Equal(key) {
+			t.Errorf("%s: parsed a different key", name)
+		}
+	}
+	if _, err := parsePrivateKey("not a key"); err == nil {
+		t.Error("expected an error without a PEM block")
+	}
+}
+
+func TestAppJWT(t *testing.T) {
+	key, _ := testAppKey(t)
+	token, err := (&appJWTSource{appID: 42, key: key}).Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+
+	parts := strings.Split(token.AccessToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("jwt has %d parts, want 3", len(parts))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("decoding signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+
+	var header map[string]string
+	decodeSegment(t, parts[0], &header)
+	if header["alg"] != "RS256" {
+		t.Errorf("alg = %q, want RS256", header["alg"])
+	}
+
+	var claims struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}
+	decodeSegment(t, parts[1], &claims)
+	if claims.Issuer != "42" {
+		t.Errorf("iss = %q, want 42", claims.Issuer)
+	}
+	now := time.Now().Unix()
+	if claims.IssuedAt > now {
+		t.Errorf("iat is %d seconds in the future", claims.IssuedAt-now)
+	}
+	// GitHub rejects JWTs valid for more than 10 minutes
+	if lifetime := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second; lifetime > 10*time.Minute {
+		t.Errorf("jwt is valid for %s, want at most 10m", lifetime)
+	}
+	if !token.Expiry.Before(time.Unix(claims.ExpiresAt, 0)) {
+		t.Error("token is reused until the jwt expires")
+	}
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatalf("decoding jwt segment: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decoding jwt segment: %v", err)
+	}
+}
+
+// fakeAppAPI serves the installation endpoints of a GitHub App installed in
+// acme (looked up) and globex (configured), and records the token each
+// organization request was made with
+type fakeAppAPI struct {
+	mu      sync.Mutex
+	lookups int
+	minted  map[string]int
+	auth    map[string]string // request path -> Authorization header
+}
+
+func (f *fakeAppAPI) handler(t *testing.T) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /orgs/{org}/installation", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.lookups++
+		f.mu.Unlock()
+		if r.PathValue("org") != "acme" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"id": 1})
+	})
+	mux.HandleFunc("POST /app/installations/{id}/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			t.Errorf("installation token requested without the app jwt")
+		}
+		f.mu.Lock()
+		f.minted[r.PathValue("id")]++
+		f.mu.Unlock()
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"token":      "installation-" + r.PathValue("id"),
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	})
+	record := func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.auth[r.URL.Path] = r.Header.Get("Authorization")
+		f.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]string{"login": "x"})
+	}
+	mux.HandleFunc("GET /orgs/{org}", record)
+	mux.HandleFunc("GET /users/{user}", record)
+	return mux
+}
+
+func newTestAppClient(t *testing.T, api *fakeAppAPI) *Client {
+	t.Helper()
+	server := httptest.NewServer(api.handler(t))
+	t.Cleanup(server.Close)
+
+	_, key := testAppKey(t)
+	client, err := NewAppClient(AppConfig{
+		AppID:         42,
+		PrivateKey:    key,
+		Installations: map[string]int64{"Globex": 2},
+		DefaultOrg:    "globex",
+	}, server.URL)
+	if err != nil {
+		t.Fatalf("NewAppClient: %v", err)
+	}
+	return client
+}
+
+func TestAppTransport(t *testing.T) {
+	api := &fakeAppAPI{minted: make(map[string]int), auth: make(map[string]string)}
+	client := newTestAppClient(t, api)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := client.client.Organizations.Get(ctx, "acme"); err != nil {
+			t.Fatalf("Organizations.Get: %v", err)
+		}
+	}
+	if _, _, err := client.client.Users.Get(ctx, "octocat"); err != nil {
+		t.Fatalf("Users.Get: %v", err)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if got := api.auth["/orgs/acme"]; got != "token installation-1" {
+		t.Errorf("acme request authorized with %q, want its installation token", got)
+	}
+	if got := api.auth["/users/octocat"]; got != "token installation-2" {
+		t.Errorf("user request authorized with %q, want the default organization's token", got)
+	}
+	// The installation is looked up and its token minted once
+	if api.lookups != 1 || api.minted["1"] != 1 {
+		t.Errorf("%d lookups and %d tokens minted for acme, want 1 each", api.lookups, api.minted["1"])
+	}
+}
+
+func TestAppTransportNotInstalled(t *testing.T) {
+	api := &fakeAppAPI{minted: make(map[string]int), auth: make(map[string]string)}
+	client := newTestAppClient(t, api)
+
+	_, _, err := client.client.Organizations.Get(context.Background(), "initech")
+	if err == nil || !strings.Contains(err.Error(), "not installed in org initech") {
+		t.Errorf("err = %v, want the app reported as not installed", err)
+	}
+}
+
+func TestNewAppClientRequiresDefaultOrg(t *testing.T) {
+	_, key := testAppKey(t)
+	if _, err := NewAppClient(AppConfig{AppID: 42, PrivateKey: key}, ""); err == nil {
+		t.Error("expected an error without a default organization")
+	}
+}
@@ -2,14 +2,30 @@ package github
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/go-github/v60/github"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
 )
 
+var (
+	// ErrUserNotFound is returned when a GitHub user does not exist
+	ErrUserNotFound = errors.New("github user not found")
+	// ErrTeamNotFound is returned when a team does not exist in an organization
+	ErrTeamNotFound = errors.New("github team not found")
+	// ErrMembershipNotFound is returned when a user is not a member of a team
+	ErrMembershipNotFound = errors.New("github team membership not found")
+)
+
 type Client struct {
 	client *github.Client
+	app    *github.Client // set when authenticated as a GitHub App
 	ctx    context.Context
 }
 
@@ -27,7 +43,35 @@ func NewClient(token string) *Client {
 	}
 }
 
+// NewClientWithBaseURL creates a client that talks to the given API base URL
+// instead of api.github.com, e.g. a GitHub Enterprise Server or a test server.
+func NewClientWithBaseURL(token, baseURL string) (*Client, error) {
+	u, err := parseBaseURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClient(token)
+	c.client.BaseURL = u
+	return c, nil
+}
+
+func parseBaseURL(baseURL string) (*url.URL, error) {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing base url %s: %v", baseURL, err)
+	}
+	return u, nil
+}
+
 func (c *Client) ListOrganizations() ([]*github.Organization, error) {
+	if c.app != nil {
+		return c.listInstalledOrganizations()
+	}
+
 	opts := &github.ListOptions{
 		PerPage: 100,
 	}
@@ -73,8 +117,483 @@ func (c *Client) CreateTeam(org string, team *github.NewTeam) (*github.Team, err
 	return newTeam, nil
 }
 
-func (c *Client) SendCopilotInvite(org, team, username string) error {
-	// Note: This is a placeholder for the actual Copilot invite API
-	// GitHub's API for Copilot management might require specific endpoints or permissions
-	return fmt.Errorf("copilot invite functionality not implemented")
+func (c *Client) GetUser(username string) (*github.User, error) {
+	user, resp, err := c.client.Users.Get(c.ctx, username)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("error getting user %s: %v", username, err)
+	}
+	return user, nil
+}
+
+// GetTeam returns a team of the organization by its slug
+func (c *Client) GetTeam(org, slug string) (*github.Team, error) {
+	team, resp, err := c.client.Teams.GetTeamBySlug(c.ctx, org, slug)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, ErrTeamNotFound
+		}
+		return nil, fmt.Errorf("error getting team %s in org %s: %v", slug, org, err)
+	}
+	return team, nil
+}
+
+// UpdateTeam changes the name, description, privacy or parent of a team. An
+// empty name keeps the current name; removeParent moves the team to the top
+// level.
+func (c *Client) UpdateTeam(org, slug string, team *github.NewTeam, removeParent bool) (*github.Team, error) {
+	if team.Name == "" {
+		current, err := c.GetTeam(org, slug)
+		if err != nil {
+			return nil, err
+		}
+		team.Name = current.GetName()
+	}
+
+	updated, resp, err := c.client.Teams.EditTeamBySlug(c.ctx, org, slug, *team, removeParent)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, ErrTeamNotFound
+		}
+		return nil, fmt.Errorf("error updating team %s in org %s: %v", slug, org, err)
+	}
+	return updated, nil
+}
+
+func (c *Client) DeleteTeam(org, slug string) error {
+	resp, err := c.client.Teams.DeleteTeamBySlug(c.ctx, org, slug)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return ErrTeamNotFound
+		}
+		return fmt.Errorf("error deleting team %s in org %s: %v", slug, org, err)
+	}
+	return nil
+}
+
+func (c *Client) ListTeamMembers(org, slug string) ([]*github.User, error) {
+	return c.listTeamMembers(org, slug, "all")
+}
+
+// ListTeamMaintainers lists the members of a team with the maintainer role
+func (c *Client) ListTeamMaintainers(org, slug string) ([]*github.User, error) {
+	return c.listTeamMembers(org, slug, "maintainer")
+}
+
+func (c *Client) listTeamMembers(org, slug, role string) ([]*github.User, error) {
+	opts := &github.TeamListTeamMembersOptions{
+		Role:        role,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var allMembers []*github.User
+	for {
+		members, resp, err := c.client.Teams.ListTeamMembersBySlug(c.ctx, org, slug, opts)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return nil, ErrTeamNotFound
+			}
+			return nil, fmt.Errorf("error listing members of team %s in org %s: %v", slug, org, err)
+		}
+		allMembers = append(allMembers, members...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return allMembers, nil
+}
+
+func (c *Client) ListChildTeams(org, slug string) ([]*github.Team, error) {
+	opts := &github.ListOptions{
+		PerPage: 100,
+	}
+	var allTeams []*github.Team
+	for {
+		teams, resp, err := c.client.Teams.ListChildTeamsByParentSlug(c.ctx, org, slug, opts)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return nil, ErrTeamNotFound
+			}
+			return nil, fmt.Errorf("error listing child teams of team %s in org %s: %v", slug, org, err)
+		}
+		allTeams = append(allTeams, teams...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return allTeams, nil
+}
+
+// GetOrgMembershipState returns "active" or "pending" (invited but not yet
+// joined) for a user of the organization, or "" if the user is neither
+func (c *Client) GetOrgMembershipState(org, username string) (string, error) {
+	membership, resp, err := c.client.Organizations.GetOrgMembership(c.ctx, username, org)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("error getting membership of %s in org %s: %v", username, org, err)
+	}
+	return membership.GetState(), nil
+}
+
+// HasCopilotSeat reports whether a user holds a Copilot seat in the organization
+func (c *Client) HasCopilotSeat(org, username string) (bool, error) {
+	_, resp, err := c.client.Copilot.GetSeatDetails(c.ctx, org, username)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error getting copilot seat of %s in org %s: %v", username, org, err)
+	}
+	return true, nil
+}
+
+// TeamMembership is a user's membership of a team
+type TeamMembership struct {
+	Team  string `json:"team"`
+	Role  string `json:"role"`
+	State string `json:"state"` // pending until the user accepts their org invitation
+	Added bool   `json:"added"` // whether the membership was created or changed
+
+	Created      bool   `json:"-"` // the user was not a member of the team before
+	PreviousRole string `json:"-"` // the role the user had before it was changed
+}
+
+// GetTeamMembership returns a user's membership of a team, or nil if the
+// user is not a member
+func (c *Client) GetTeamMembership(org, team, username string) (*TeamMembership, error) {
+	membership, resp, err := c.client.Teams.GetTeamMembershipBySlug(c.ctx, org, team, username)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting membership of %s in team %s: %v", username, team, err)
+	}
+	return &TeamMembership{
+		Team:  team,
+		Role:  membership.GetRole(),
+		State: membership.GetState(),
+	}, nil
+}
+
+// EnsureTeamMembership adds a user to a team with the given role (member or
+// maintainer), leaving an existing membership alone if no role is given or
+// it already has the role. A user who is not yet an organization member is
+// invited to the organization and stays pending until they accept.
+func (c *Client) EnsureTeamMembership(org, team, username, role string) (*TeamMembership, error) {
+	existing, err := c.GetTeamMembership(org, team, username)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && (role == "" || role == existing.Role) {
+		return existing, nil
+	}
+
+	if role == "" {
+		role = "member"
+	}
+	membership, resp, err := c.client.Teams.AddTeamMembershipBySlug(c.ctx, org, team, username, &github.TeamAddTeamMembershipOptions{Role: role})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, ErrTeamNotFound
+		}
+		return nil, fmt.Errorf("error adding %s to team %s in org %s: %v", username, team, org, err)
+	}
+	added := &TeamMembership{
+		Team:    team,
+		Role:    membership.GetRole(),
+		State:   membership.GetState(),
+		Added:   true,
+		Created: existing == nil,
+	}
+	if existing != nil {
+		added.PreviousRole = existing.Role
+	}
+	return added, nil
+}
+
+// RemoveTeamMembership removes a user from a team
+func (c *Client) RemoveTeamMembership(org, team, username string) error {
+	resp, err := c.client.Teams.RemoveTeamMembershipBySlug(c.ctx, org, team, username)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return ErrMembershipNotFound
+		}
+		return fmt.Errorf("error removing %s from team %s in org %s: %v", username, team, org, err)
+	}
+	return nil
+}
+
+// TwoFactorDisabled reports whether an organization member has two-factor
+// authentication disabled. Only organization owners can see this.
+func (c *Client) TwoFactorDisabled(org, username string) (bool, error) {
+	opts := &github.ListMembersOptions{
+		Filter:      "2fa_disabled",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		members, resp, err := c.client.Organizations.ListMembers(c.ctx, org, opts)
+		if err != nil {
+			return false, fmt.Errorf("error listing members without 2fa for org %s: %v", org, err)
+		}
+		for _, member := range members {
+			if strings.EqualFold(member.GetLogin(), username) {
+				return true, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return false, nil
+}
+
+const samlIdentityQuery = `query($org: String!, $login: String!) {
+  organization(login: $org) {
+    samlIdentityProvider {
+      externalIdentities(first: 1, login: $login) {
+        nodes { user { login } }
+      }
+    }
+  }
+}`
+
+// HasSAMLIdentity reports whether a user has linked a SAML identity to the
+// organization's identity provider. The REST API does not expose this, so
+// it is read through GraphQL.
+func (c *Client) HasSAMLIdentity(org, username string) (bool, error) {
+	// GraphQL is served at /api/graphql on GitHub Enterprise Server
+	path := "graphql"
+	if strings.HasSuffix(c.client.BaseURL.Path, "/api/v3/") {
+		path = "../graphql"
+	}
+
+	body := map[string]interface{}{
+		"query":     samlIdentityQuery,
+		"variables": map[string]string{"org": org, "login": username},
+	}
+	req, err := c.client.NewRequest("POST", path, body)
+	if err != nil {
+		return false, fmt.Errorf("error creating saml identity request for org %s: %v", org, err)
+	}
+
+	var result struct {
+		Data struct {
+			Organization *struct {
+				SAMLIdentityProvider *struct {
+					ExternalIdentities struct {
+						Nodes []struct {
+							User *struct {
+								Login string `json:"login"`
+							} `json:"user"`
+						} `json:"nodes"`
+					} `json:"externalIdentities"`
+				} `json:"samlIdentityProvider"`
+			} `json:"organization"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err := c.client.Do(withOrg(c.ctx, org), req, &result); err != nil {
+		return false, fmt.Errorf("error getting saml identity of %s in org %s: %v", username, org, err)
+	}
+	if len(result.Errors) > 0 {
+		return false, fmt.Errorf("error getting saml identity of %s in org %s: %s", username, org, result.Errors[0].Message)
+	}
+
+	organization := result.Data.Organization
+	if organization == nil || organization.SAMLIdentityProvider == nil {
+		return false, nil
+	}
+	for _, node := range organization.SAMLIdentityProvider.ExternalIdentities.Nodes {
+		if node.User != nil && strings.EqualFold(node.User.Login, username) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CopilotSeat describes a Copilot seat held in an organization.
+type CopilotSeat struct {
+	Assignee                string     `json:"assignee"`
+	AssigningTeam           string     `json:"assigning_team,omitempty"`
+	CreatedAt               *time.Time `json:"created_at,omitempty"`
+	LastActivityAt          *time.Time `json:"last_activity_at,omitempty"`
+	LastActivityEditor      string     `json:"last_activity_editor,omitempty"`
+	PendingCancellationDate string     `json:"pending_cancellation_date,omitempty"`
+}
+
+func (c *Client) ListCopilotSeats(org string) ([]*CopilotSeat, error) {
+	opts := &github.ListOptions{
+		PerPage: 100,
+	}
+	var allSeats []*CopilotSeat
+	for {
+		seats, resp, err := c.client.Copilot.ListCopilotSeats(c.ctx, org, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error listing copilot seats for org %s: %v", org, err)
+		}
+		for _, seat := range seats.Seats {
+			allSeats = append(allSeats, newCopilotSeat(seat))
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return allSeats, nil
+}
+
+func newCopilotSeat(details *github.CopilotSeatDetails) *CopilotSeat {
+	seat := &CopilotSeat{
+		LastActivityEditor:      details.GetLastActivityEditor(),
+		PendingCancellationDate: details.GetPendingCancellationDate(),
+	}
+	if user, ok := details.GetUser(); ok {
+		seat.Assignee = user.GetLogin()
+	} else if team, ok := details.GetTeam(); ok {
+		seat.Assignee = team.GetSlug()
+	}
+	if details.AssigningTeam != nil {
+		seat.AssigningTeam = details.AssigningTeam.GetSlug()
+	}
+	if details.CreatedAt != nil {
+		seat.CreatedAt = &details.CreatedAt.Time
+	}
+	if details.LastActivityAt != nil {
+		seat.LastActivityAt = &details.LastActivityAt.Time
+	}
+	return seat
+}
+
+// CopilotBilling holds the Copilot plan and seat usage of an organization.
+type CopilotBilling struct {
+	PlanType              string                      `json:"plan_type"`
+	SeatBreakdown         github.CopilotSeatBreakdown `json:"seat_breakdown"`
+	SeatManagementSetting string                      `json:"seat_management_setting"`
+}
+
+func (c *Client) GetCopilotBilling(org string) (*CopilotBilling, error) {
+	// go-github does not expose plan_type, so decode the response ourselves
+	req, err := c.client.NewRequest("GET", fmt.Sprintf("orgs/%s/copilot/billing", org), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating copilot billing request for org %s: %v", org, err)
+	}
+
+	var billing CopilotBilling
+	if _, err := c.client.Do(c.ctx, req, &billing); err != nil {
+		return nil, fmt.Errorf("error getting copilot billing for org %s: %v", org, err)
+	}
+	return &billing, nil
+}
+
+// CopilotSeatAssignment is the outcome of assigning a Copilot seat.
+type CopilotSeatAssignment struct {
+	Organization      string `json:"organization"`
+	Username          string `json:"username,omitempty"`
+	Team              string `json:"team,omitempty"`
+	SeatsCreated      int    `json:"seats_created"`
+	AlreadyAssigned   bool   `json:"already_assigned"`
+	PendingInvitation bool   `json:"pending_invitation"`
+
+	// TeamMembership is set when the user was also added to a team
+	TeamMembership *TeamMembership `json:"team_membership,omitempty"`
+}
+
+// SendCopilotInvite assigns a Copilot seat to a single user of the organization.
+func (c *Client) SendCopilotInvite(org, username string) (*CopilotSeatAssignment, error) {
+	seats, _, err := c.client.Copilot.AddCopilotUsers(c.ctx, org, []string{username})
+	if err != nil {
+		return nil, fmt.Errorf("error assigning copilot seat to %s in org %s: %v", username, org, err)
+	}
+
+	result := &CopilotSeatAssignment{
+		Organization:    org,
+		Username:        username,
+		SeatsCreated:    seats.SeatsCreated,
+		AlreadyAssigned: seats.SeatsCreated == 0,
+	}
+
+	// A seat for a user who has not accepted their org invitation yet stays
+	// pending until they join. The seat exists either way, so a failed lookup
+	// must not fail the assignment.
+	state, err := c.GetOrgMembershipState(org, username)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("org", org).
+			Str("username", username).
+			Msg("Copilot seat assigned but membership state unknown")
+		return result, nil
+	}
+	result.PendingInvitation = state == "pending"
+
+	return result, nil
+}
+
+// SendCopilotTeamInvite assigns Copilot seats to every member of a team.
+func (c *Client) SendCopilotTeamInvite(org, team string) (*CopilotSeatAssignment, error) {
+	seats, _, err := c.client.Copilot.AddCopilotTeams(c.ctx, org, []string{team})
+	if err != nil {
+		return nil, fmt.Errorf("error assigning copilot seats to team %s in org %s: %v", team, org, err)
+	}
+
+	return &CopilotSeatAssignment{
+		Organization:    org,
+		Team:            team,
+		SeatsCreated:    seats.SeatsCreated,
+		AlreadyAssigned: seats.SeatsCreated == 0,
+	}, nil
+}
+
+// CopilotSeatCancellation is the outcome of cancelling Copilot seats.
+type CopilotSeatCancellation struct {
+	Organization            string `json:"organization"`
+	Username                string `json:"username,omitempty"`
+	Team                    string `json:"team,omitempty"`
+	SeatsCancelled          int    `json:"seats_cancelled"`
+	PendingCancellationDate string `json:"pending_cancellation_date,omitempty"`
+}
+
+// RevokeCopilotSeat cancels the Copilot seat of a single user. GitHub keeps
+// the seat until the end of the billing cycle and reports that date back.
+func (c *Client) RevokeCopilotSeat(org, username string) (*CopilotSeatCancellation, error) {
+	seats, _, err := c.client.Copilot.RemoveCopilotUsers(c.ctx, org, []string{username})
+	if err != nil {
+		return nil, fmt.Errorf("error cancelling copilot seat of %s in org %s: %v", username, org, err)
+	}
+
+	result := &CopilotSeatCancellation{
+		Organization:   org,
+		Username:       username,
+		SeatsCancelled: seats.SeatsCancelled,
+	}
+
+	// The seat may already be gone, in which case there is no date to report
+	details, _, err := c.client.Copilot.GetSeatDetails(c.ctx, org, username)
+	if err == nil {
+		result.PendingCancellationDate = details.GetPendingCancellationDate()
+	}
+
+	return result, nil
+}
+
+// RevokeCopilotTeamSeats cancels the Copilot seats granted through a team.
+func (c *Client) RevokeCopilotTeamSeats(org, team string) (*CopilotSeatCancellation, error) {
+	seats, _, err := c.client.Copilot.RemoveCopilotTeams(c.ctx, org, []string{team})
+	if err != nil {
+		return nil, fmt.Errorf("error cancelling copilot seats of team %s in org %s: %v", team, org, err)
+	}
+
+	return &CopilotSeatCancellation{
+		Organization:   org,
+		Team:           team,
+		SeatsCancelled: seats.SeatsCancelled,
+	}, nil
 }
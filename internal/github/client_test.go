@@ -0,0 +1,218 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestClient returns a client talking to a stand-in for api.github.com
+// served by mux
+func newTestClient(t *testing.T, mux *http.ServeMux) *Client {
+	t.Helper()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client, err := NewClientWithBaseURL("test-token", server.URL)
+	if err != nil {
+		t.Fatalf("NewClientWithBaseURL: %v", err)
+	}
+	return client
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestSendCopilotInvite(t *testing.T) {
+	tests := []struct {
+		name         string
+		seatsCreated int
+		state        string
+		stateStatus  int
+		want         CopilotSeatAssignment
+	}{
+		{
+			name:         "seat created for active member",
+			seatsCreated: 1,
+			state:        "active",
+			stateStatus:  http.StatusOK,
+			want:         CopilotSeatAssignment{Organization: "acme", Username: "octocat", SeatsCreated: 1},
+		},
+		{
+			name:         "seat already assigned",
+			seatsCreated: 0,
+			state:        "active",
+			stateStatus:  http.StatusOK,
+			want:         CopilotSeatAssignment{Organization: "acme", Username: "octocat", AlreadyAssigned: true},
+		},
+		{
+			name:         "pending org invitation",
+			seatsCreated: 1,
+			state:        "pending",
+			stateStatus:  http.StatusOK,
+			want:         CopilotSeatAssignment{Organization: "acme", Username: "octocat", SeatsCreated: 1, PendingInvitation: true},
+		},
+		{
+			name:         "membership lookup fails after the seat was created",
+			seatsCreated: 1,
+			stateStatus:  http.StatusInternalServerError,
+			want:         CopilotSeatAssignment{Organization: "acme", Username: "octocat", SeatsCreated: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/orgs/acme/copilot/billing/selected_users", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					t.Errorf("method = %s, want POST", r.Method)
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+					t.Errorf("Authorization = %q", got)
+				}
+				var body struct {
+					SelectedUsernames []string `json:"selected_usernames"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				if len(body.SelectedUsernames) != 1 || body.SelectedUsernames[0] != "octocat" {
+					t.Errorf("selected_usernames = %v", body.SelectedUsernames)
+				}
+				writeJSON(w, http.StatusCreated, map[string]int{"seats_created": tt.seatsCreated})
+			})
+			mux.HandleFunc("/orgs/acme/memberships/octocat", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, tt.stateStatus, map[string]string{"state": tt.state})
+			})
+
+			got, err := newTestClient(t, mux).SendCopilotInvite("acme", "octocat")
+			if err != nil {
+				t.Fatalf("SendCopilotInvite: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("assignment = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendCopilotInviteRejected(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/copilot/billing/selected_users", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Copilot is not enabled"})
+	})
+
+	if _, err := newTestClient(t, mux).SendCopilotInvite("acme", "octocat"); err == nil {
+		t.Fatal("expected an error when GitHub rejects the seat")
+	}
+}
+
+func TestSendCopilotTeamInvite(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/copilot/billing/selected_teams", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"selected_teams":["platform"]}`+"\n" {
+			t.Errorf("body = %s", body)
+		}
+		writeJSON(w, http.StatusCreated, map[string]int{"seats_created": 12})
+	})
+
+	got, err := newTestClient(t, mux).SendCopilotTeamInvite("acme", "platform")
+	if err != nil {
+		t.Fatalf("SendCopilotTeamInvite: %v", err)
+	}
+	want := CopilotSeatAssignment{Organization: "acme", Team: "platform", SeatsCreated: 12}
+	if *got != want {
+		t.Errorf("assignment = %+v, want %+v", *got, want)
+	}
+}
+
+func TestRevokeCopilotSeat(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/copilot/billing/selected_users", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("method = %s, want DELETE", r.Method)
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"seats_cancelled": 1})
+	})
+	mux.HandleFunc("/orgs/acme/members/octocat/copilot", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"assignee":                  map[string]interface{}{"login": "octocat", "type": "User"},
+			"pending_cancellation_date": "2026-11-01",
+		})
+	})
+
+	got, err := newTestClient(t, mux).RevokeCopilotSeat("acme", "octocat")
+	if err != nil {
+		t.Fatalf("RevokeCopilotSeat: %v", err)
+	}
+	want := CopilotSeatCancellation{Organization: "acme", Username: "octocat", SeatsCancelled: 1, PendingCancellationDate: "2026-11-01"}
+	if *got != want {
+		t.Errorf("cancellation = %+v, want %+v", *got, want)
+	}
+}
+
+func TestRevokeCopilotSeatAlreadyGone(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/copilot/billing/selected_users", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]int{"seats_cancelled": 0})
+	})
+	mux.HandleFunc("/orgs/acme/members/octocat/copilot", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+	})
+
+	got, err := newTestClient(t, mux).RevokeCopilotSeat("acme", "octocat")
+	if err != nil {
+		t.Fatalf("RevokeCopilotSeat: %v", err)
+	}
+	if got.SeatsCancelled != 0 || got.PendingCancellationDate != "" {
+		t.Errorf("cancellation = %+v, want nothing cancelled", *got)
+	}
+}
+
+func TestRevokeCopilotTeamSeats(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orgs/acme/copilot/billing/selected_teams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("method = %s, want DELETE", r.Method)
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"seats_cancelled": 3})
+	})
+
+	got, err := newTestClient(t, mux).RevokeCopilotTeamSeats("acme", "platform")
+	if err != nil {
+		t.Fatalf("RevokeCopilotTeamSeats: %v", err)
+	}
+	want := CopilotSeatCancellation{Organization: "acme", Team: "platform", SeatsCancelled: 3}
+	if *got != want {
+		t.Errorf("cancellation = %+v, want %+v", *got, want)
+	}
+}
+
+func TestGetUserNotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/ghost", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+	})
+
+	_, err := newTestClient(t, mux).GetUser("ghost")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestGetUserFailure(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/octocat", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "boom"})
+	})
+
+	_, err := newTestClient(t, mux).GetUser("octocat")
+	if err == nil || errors.Is(err, ErrUserNotFound) {
+		t.Errorf("err = %v, want a lookup failure", err)
+	}
+}
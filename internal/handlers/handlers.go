@@ -1,10 +1,22 @@
 package handlers
 
 import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github-copilot-invite/internal/authz"
+	"github-copilot-invite/internal/desired"
 	"github-copilot-invite/internal/github"
-	"github-copilot-invite/internal/smartsheet"
+	"github-copilot-invite/internal/invite"
+	"github-copilot-invite/internal/jobs"
+	"github-copilot-invite/internal/license"
+	"github-copilot-invite/internal/middleware"
+	"github-copilot-invite/internal/reconcile"
 
 	"github.com/gin-gonic/gin"
 	gh "github.com/google/go-github/v60/github"
@@ -12,13 +24,23 @@ import (
 
 type Handler struct {
 	githubClient *github.Client
-	validator    *smartsheet.LicenseValidator
+	licenses     license.Store
+	invites      *invite.Service
+	jobs         *jobs.Manager
+	reconciler   *reconcile.Reconciler
+	planner      *desired.Planner
+	authz        *authz.Authorizer // nil when role-based access control is off
 }
 
-func NewHandler(githubToken string, smartsheetToken string, sheetID int64) *Handler {
+func NewHandler(githubClient *github.Client, licenses license.Store, invites *invite.Service, jobManager *jobs.Manager, reconciler *reconcile.Reconciler, planner *desired.Planner, authorizer *authz.Authorizer) *Handler {
 	return &Handler{
-		githubClient: github.NewClient(githubToken),
-		validator:    smartsheet.NewLicenseValidator(smartsheetToken, sheetID),
+		githubClient: githubClient,
+		licenses:     licenses,
+		invites:      invites,
+		jobs:         jobManager,
+		reconciler:   reconciler,
+		planner:      planner,
+		authz:        authorizer,
 	}
 }
 
@@ -28,7 +50,16 @@ func (h *Handler) ListOrganizations(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, orgs)
+
+	// Only show the organizations the client may act on and read
+	client := middleware.Identity(c)
+	allowed := make([]*gh.Organization, 0, len(orgs))
+	for _, org := range orgs {
+		if (client == nil || client.AllowsOrg(org.GetLogin())) && h.allows(c, authz.ActionRead, org.GetLogin(), "") {
+			allowed = append(allowed, org)
+		}
+	}
+	c.JSON(http.StatusOK, allowed)
 }
 
 func (h *Handler) ListTeams(c *gin.Context) {
@@ -38,6 +69,10 @@ func (h *Handler) ListTeams(c *gin.Context) {
 		return
 	}
 
+	if h.forbidden(c, authz.ActionRead, org, "") {
+		return
+	}
+
 	teams, err := h.githubClient.ListTeams(org)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -52,6 +87,9 @@ func (h *Handler) CreateTeam(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "organization name is required"})
 		return
 	}
+	if h.forbidden(c, authz.ActionManageTeams, org, "") {
+		return
+	}
 
 	var newTeam gh.NewTeam
 	if err := c.BindJSON(&newTeam); err != nil {
@@ -59,6 +97,11 @@ func (h *Handler) CreateTeam(c *gin.Context) {
 		return
 	}
 
+	if isDryRun(c) {
+		h.previewTeam(c, org, &newTeam)
+		return
+	}
+
 	team, err := h.githubClient.CreateTeam(org, &newTeam)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -67,43 +110,673 @@ func (h *Handler) CreateTeam(c *gin.Context) {
 	c.JSON(http.StatusCreated, team)
 }
 
-type CopilotInviteRequest struct {
-	Organization string `json:"organization" binding:"required"`
-	Team        string `json:"team" binding:"required"`
-	Username    string `json:"username" binding:"required"`
+func (h *Handler) GetTeam(c *gin.Context) {
+	if h.forbidden(c, authz.ActionRead, c.Param("org"), c.Param("team_slug")) {
+		return
+	}
+	team, err := h.githubClient.GetTeam(c.Param("org"), c.Param("team_slug"))
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, team)
+}
+
+// UpdateTeamRequest holds the team fields to change; omitted fields are left
+// as they are
+type UpdateTeamRequest struct {
+	Name         string  `json:"name"`
+	Description  *string `json:"description"`
+	Privacy      *string `json:"privacy" binding:"omitempty,oneof=secret closed"`
+	ParentTeamID *int64  `json:"parent_team_id"`
+	RemoveParent bool    `json:"remove_parent"`
+}
+
+func (h *Handler) UpdateTeam(c *gin.Context) {
+	var req UpdateTeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RemoveParent && req.ParentTeamID != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "parent_team_id and remove_parent cannot be combined"})
+		return
+	}
+
+	// Moving a team changes the organization's hierarchy, not just the team
+	scope := c.Param("team_slug")
+	if req.RemoveParent || req.ParentTeamID != nil {
+		scope = ""
+	}
+	if h.forbidden(c, authz.ActionManageTeams, c.Param("org"), scope) {
+		return
+	}
+
+	team, err := h.githubClient.UpdateTeam(c.Param("org"), c.Param("team_slug"), &gh.NewTeam{
+		Name:         req.Name,
+		Description:  req.Description,
+		Privacy:      req.Privacy,
+		ParentTeamID: req.ParentTeamID,
+	}, req.RemoveParent)
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, team)
+}
+
+func (h *Handler) DeleteTeam(c *gin.Context) {
+	if h.forbidden(c, authz.ActionManageTeams, c.Param("org"), c.Param("team_slug")) {
+		return
+	}
+	if err := h.githubClient.DeleteTeam(c.Param("org"), c.Param("team_slug")); err != nil {
+		teamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "team deleted successfully"})
 }
 
+func (h *Handler) ListTeamMembers(c *gin.Context) {
+	if h.forbidden(c, authz.ActionRead, c.Param("org"), c.Param("team_slug")) {
+		return
+	}
+	members, err := h.githubClient.ListTeamMembers(c.Param("org"), c.Param("team_slug"))
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, members)
+}
+
+type TeamMemberRequest struct {
+	Role string `json:"role" binding:"omitempty,oneof=member maintainer"`
+}
+
+// AddTeamMember adds a user to a team, or changes their role. The body is
+// optional.
+func (h *Handler) AddTeamMember(c *gin.Context) {
+	if h.forbidden(c, authz.ActionManageTeams, c.Param("org"), c.Param("team_slug")) {
+		return
+	}
+	var req TeamMemberRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	membership, err := h.githubClient.EnsureTeamMembership(c.Param("org"), c.Param("team_slug"), c.Param("username"), req.Role)
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, membership)
+}
+
+func (h *Handler) RemoveTeamMember(c *gin.Context) {
+	if h.forbidden(c, authz.ActionManageTeams, c.Param("org"), c.Param("team_slug")) {
+		return
+	}
+	if err := h.githubClient.RemoveTeamMembership(c.Param("org"), c.Param("team_slug"), c.Param("username")); err != nil {
+		teamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "member removed successfully"})
+}
+
+func (h *Handler) ListChildTeams(c *gin.Context) {
+	if h.forbidden(c, authz.ActionRead, c.Param("org"), c.Param("team_slug")) {
+		return
+	}
+	teams, err := h.githubClient.ListChildTeams(c.Param("org"), c.Param("team_slug"))
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, teams)
+}
+
+// teamError writes the response for a failed team request
+func teamError(c *gin.Context, err error) {
+	if errors.Is(err, github.ErrTeamNotFound) || errors.Is(err, github.ErrMembershipNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func (h *Handler) ListCopilotSeats(c *gin.Context) {
+	org := c.Param("org")
+	if org == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization name is required"})
+		return
+	}
+	if h.forbidden(c, authz.ActionRead, org, "") {
+		return
+	}
+
+	seats, err := h.githubClient.ListCopilotSeats(org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, seats)
+}
+
+func (h *Handler) GetCopilotBilling(c *gin.Context) {
+	org := c.Param("org")
+	if org == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization name is required"})
+		return
+	}
+	if h.forbidden(c, authz.ActionRead, org, "") {
+		return
+	}
+
+	billing, err := h.githubClient.GetCopilotBilling(org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	available, err := h.licenses.Check(org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check license availability"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"organization":            org,
+		"plan_type":               billing.PlanType,
+		"seat_breakdown":          billing.SeatBreakdown,
+		"seat_management_setting": billing.SeatManagementSetting,
+		"available_licenses":      available,
+	})
+}
+
+type CopilotInviteRequest = invite.Request
+
 func (h *Handler) SendCopilotInvite(c *gin.Context) {
 	var req CopilotInviteRequest
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if forbidOrgs(c, req.Organization) || h.forbidden(c, authz.ActionAssignSeats, req.Organization, req.Team) {
+		return
+	}
+
+	if isDryRun(c) {
+		preview, err := h.invites.Preview(req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check license availability"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "preview": preview})
+		return
+	}
+
+	assignment, err := h.invites.Invite(req)
+	if err != nil {
+		h.inviteError(c, err)
+		return
+	}
+
+	if assignment.AlreadyAssigned {
+		c.JSON(http.StatusOK, gin.H{"message": "user already has a copilot seat", "assignment": assignment})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "invite sent successfully", "assignment": assignment})
+}
+
+type BulkInviteRequest struct {
+	Invites []CopilotInviteRequest `json:"invites" binding:"required,dive"`
+}
+
+// SendBulkCopilotInvite invites a batch of users given as JSON or as a CSV
+// file with the header organization,team,username
+func (h *Handler) SendBulkCopilotInvite(c *gin.Context) {
+	reqs, err := bindBulkInvites(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(reqs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no invites given"})
+		return
+	}
+	if h.forbidInvites(c, reqs) {
+		return
+	}
+
+	if isDryRun(c) {
+		h.previewBatch(c, reqs)
+		return
+	}
+
+	results := h.invites.InviteBatch(reqs)
+
+	summary := make(map[invite.Status]int)
+	for _, result := range results {
+		summary[result.Status]++
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results, "summary": summary})
+}
+
+// CreateInviteJob queues a batch of invites, in the same formats as
+// SendBulkCopilotInvite, to be processed in the background
+func (h *Handler) CreateInviteJob(c *gin.Context) {
+	reqs, err := bindBulkInvites(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(reqs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no invites given"})
+		return
+	}
+	if h.forbidInvites(c, reqs) {
+		return
+	}
 
-	// Check license availability
-	available, err := h.validator.CheckLicenseAvailability(req.Organization)
+	if isDryRun(c) {
+		h.previewBatch(c, reqs)
+		return
+	}
+
+	shortfalls, err := h.invites.CheckLicenses(reqs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check license availability"})
+		return
+	}
+	if len(shortfalls) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "not enough licenses for this batch", "shortfalls": shortfalls})
+		return
+	}
+
+	job, err := h.jobs.Submit(reqs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	statusURL := "/api/v1/jobs/" + job.ID
+	c.Header("Location", statusURL)
+	c.JSON(http.StatusAccepted, gin.H{"id": job.ID, "status": job.Status, "status_url": statusURL})
+}
+
+func (h *Handler) GetJob(c *gin.Context) {
+	job, exists := h.jobs.Get(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+	for _, item := range job.Items {
+		if forbidOrgs(c, item.Organization) || h.forbidden(c, authz.ActionRead, item.Organization, item.Team) {
+			return
+		}
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// previewBatch writes what a batch of invites would do, without assigning
+// seats or reserving licenses
+func (h *Handler) previewBatch(c *gin.Context, reqs []CopilotInviteRequest) {
+	previews, err := h.invites.PreviewBatch(reqs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check license availability"})
 		return
 	}
 
-	if !available {
+	summary := make(map[invite.Status]int)
+	licenses := make(map[string]int)
+	for _, preview := range previews {
+		summary[preview.Status]++
+		if preview.Status == invite.StatusAssigned {
+			licenses[preview.Organization]++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"dry_run": true, "previews": previews, "summary": summary, "licenses_required": licenses})
+}
+
+// previewTeam writes whether a team could be created, without creating it
+func (h *Handler) previewTeam(c *gin.Context, org string, newTeam *gh.NewTeam) {
+	teams, err := h.githubClient.ListTeams(org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	nameFree := invite.Check{Name: "name_available", Passed: true}
+	parentExists := invite.Check{Name: "parent_team_exists", Passed: newTeam.ParentTeamID == nil}
+	for _, team := range teams {
+		if strings.EqualFold(team.GetName(), newTeam.Name) {
+			nameFree.Passed = false
+			nameFree.Detail = fmt.Sprintf("team %s already exists", team.GetSlug())
+		}
+		if newTeam.ParentTeamID != nil && team.GetID() == *newTeam.ParentTeamID {
+			parentExists.Passed = true
+			parentExists.Detail = team.GetSlug()
+		}
+	}
+	if !parentExists.Passed {
+		parentExists.Detail = fmt.Sprintf("no team with id %d", *newTeam.ParentTeamID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":      true,
+		"would_create": nameFree.Passed && parentExists.Passed,
+		"team":         newTeam,
+		"checks":       []invite.Check{nameFree, parentExists},
+	})
+}
+
+// isDryRun reports whether the request asks to only validate, via
+// ?dry_run=true
+func isDryRun(c *gin.Context) bool {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	return dryRun
+}
+
+// forbidOrgs answers 403 if the client may not act on one of the
+// organizations, and reports whether it did
+func forbidOrgs(c *gin.Context, orgs ...string) bool {
+	client := middleware.Identity(c)
+	if client == nil {
+		return false
+	}
+	for _, org := range orgs {
+		if !client.AllowsOrg(org) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "client may not act on organization " + org})
+			return true
+		}
+	}
+	return false
+}
+
+// forbidInvites answers 403 if the caller may not assign a seat for one of
+// a batch of invites, and reports whether it did
+func (h *Handler) forbidInvites(c *gin.Context, reqs []CopilotInviteRequest) bool {
+	for _, req := range reqs {
+		if forbidOrgs(c, req.Organization) || h.forbidden(c, authz.ActionAssignSeats, req.Organization, req.Team) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the caller's roles allow an action on an
+// organization and team. Everything is allowed when role-based access
+// control is off.
+func (h *Handler) allows(c *gin.Context, action authz.Action, org, team string) bool {
+	if h.authz == nil {
+		return true
+	}
+	client := middleware.Identity(c)
+	if client == nil {
+		return false
+	}
+	return h.authz.Allows(authz.Subject{Name: client.Name, Groups: client.Groups}, action, org, team)
+}
+
+// forbidden answers 403 if the caller's roles do not allow an action, and
+// reports whether it did
+func (h *Handler) forbidden(c *gin.Context, action authz.Action, org, team string) bool {
+	if h.allows(c, action, org, team) {
+		return false
+	}
+
+	target := "organization " + org
+	switch {
+	case org == "":
+		target = "every organization"
+	case team != "":
+		target = fmt.Sprintf("team %s of organization %s", team, org)
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("no role allows %s on %s", action, target)})
+	return true
+}
+
+// bindBulkInvites reads the invites of a bulk request from a JSON body, a
+// CSV body or a CSV file uploaded as the "file" form field
+func bindBulkInvites(c *gin.Context) ([]CopilotInviteRequest, error) {
+	switch c.ContentType() {
+	case "text/csv":
+		return parseInviteCSV(c.Request.Body)
+	case "multipart/form-data":
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return parseInviteCSV(file)
+	default:
+		var req BulkInviteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return nil, err
+		}
+		return req.Invites, nil
+	}
+}
+
+// parseInviteCSV reads invites from CSV with the header
+// organization,team,username and an optional role column
+func parseInviteCSV(r io.Reader) ([]CopilotInviteRequest, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"organization", "team", "username"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv has no %q column", required)
+		}
+	}
+
+	reqs := make([]CopilotInviteRequest, 0, len(records)-1)
+	for _, record := range records[1:] {
+		req := CopilotInviteRequest{
+			Organization: strings.TrimSpace(record[columns["organization"]]),
+			Team:         strings.TrimSpace(record[columns["team"]]),
+			Username:     strings.TrimSpace(record[columns["username"]]),
+		}
+		if i, ok := columns["role"]; ok {
+			req.Role = strings.TrimSpace(record[i])
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// inviteError writes the response for a failed invite
+func (h *Handler) inviteError(c *gin.Context, err error) {
+	var ineligible *invite.IneligibleError
+	var uncovered *invite.UncoveredTeamError
+	switch {
+	case errors.As(err, &ineligible):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "user is not eligible for a copilot seat", "reasons": ineligible.Reasons})
+	case errors.As(err, &uncovered):
+		c.JSON(http.StatusConflict, gin.H{"error": "team has members without a copilot seat", "members": uncovered.Members})
+	case errors.Is(err, github.ErrUserNotFound):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "user is not eligible for a copilot seat", "reasons": invite.NotFoundReasons()})
+	case errors.Is(err, github.ErrTeamNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, license.ErrLicenseTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "the last license for this organization was taken by another request"})
+	case errors.Is(err, license.ErrNoLicenses):
 		c.JSON(http.StatusConflict, gin.H{"error": "no licenses available for this organization"})
+	case errors.Is(err, license.ErrReservationNotFound):
+		c.JSON(http.StatusConflict, gin.H{"error": "license reservation expired before the invite completed"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (h *Handler) RevokeCopilotSeat(c *gin.Context) {
+	org := c.Param("org")
+	username := c.Param("username")
+	if org == "" || username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization and username are required"})
+		return
+	}
+	if h.forbidden(c, authz.ActionRevokeSeats, org, "") {
 		return
 	}
 
-	// Send invite
-	if err := h.githubClient.SendCopilotInvite(req.Organization, req.Team, req.Username); err != nil {
+	cancellation, err := h.githubClient.RevokeCopilotSeat(org, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.releaseLicenses(c, cancellation)
+}
+
+func (h *Handler) RevokeCopilotTeamSeats(c *gin.Context) {
+	org := c.Param("org")
+	team := c.Param("team")
+	if org == "" || team == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization and team are required"})
+		return
+	}
+	if h.forbidden(c, authz.ActionRevokeSeats, org, team) {
+		return
+	}
+
+	cancellation, err := h.githubClient.RevokeCopilotTeamSeats(org, team)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.releaseLicenses(c, cancellation)
+}
+
+// releaseLicenses gives the cancelled seats back to the license count and
+// writes the response
+func (h *Handler) releaseLicenses(c *gin.Context, cancellation *github.CopilotSeatCancellation) {
+	if err := h.licenses.Return(cancellation.Organization, cancellation.SeatsCancelled); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "seat cancelled but failed to update license count", "cancellation": cancellation})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "seat cancelled successfully", "cancellation": cancellation})
+}
+
+func (h *Handler) RefreshLicenses(c *gin.Context) {
+	if h.forbidden(c, authz.ActionManageLicenses, "", "") {
+		return
+	}
+	if err := h.licenses.Refresh(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "license cache refreshed"})
+}
+
+func (h *Handler) ListReservations(c *gin.Context) {
+	if h.forbidden(c, authz.ActionManageLicenses, "", "") {
+		return
+	}
+	c.JSON(http.StatusOK, h.licenses.Reservations())
+}
+
+func (h *Handler) ReconcileReport(c *gin.Context) {
+	if h.forbidden(c, authz.ActionManageLicenses, "", "") {
+		return
+	}
+	report, err := h.reconciler.Run(false)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusOK, report)
+}
 
-	// Decrement license count
-	if err := h.validator.DecrementLicense(req.Organization); err != nil {
-		// Note: We might want to roll back the invite if this fails
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update license count"})
+// Plan computes the changes needed to reach the desired state given as a
+// YAML (or JSON) body, without applying them
+func (h *Handler) Plan(c *gin.Context) {
+	doc, err := desired.Parse(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if forbidOrgs(c, doc.OrganizationNames()...) {
+		return
+	}
+	for _, org := range doc.OrganizationNames() {
+		if h.forbidden(c, authz.ActionRead, org, "") {
+			return
+		}
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "invite sent successfully"})
+	plan, err := h.planner.Plan(doc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// Apply computes the plan for the desired state given as the body and
+// carries it out
+func (h *Handler) Apply(c *gin.Context) {
+	doc, err := desired.Parse(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if forbidOrgs(c, doc.OrganizationNames()...) {
+		return
+	}
+	for _, org := range doc.OrganizationNames() {
+		for _, action := range []authz.Action{authz.ActionManageTeams, authz.ActionAssignSeats, authz.ActionRevokeSeats} {
+			if h.forbidden(c, action, org, "") {
+				return
+			}
+		}
+	}
+
+	plan, err := h.planner.Apply(doc)
+	if errors.Is(err, desired.ErrInsufficientLicenses) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "plan": plan})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// ReloadPolicy reloads the role bindings from the configuration file
+func (h *Handler) ReloadPolicy(c *gin.Context) {
+	if h.authz == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role-based access control is not enabled"})
+		return
+	}
+	if h.forbidden(c, authz.ActionManagePolicy, "", "") {
+		return
+	}
+
+	if err := h.authz.Reload(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "access policy reloaded"})
 }
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseInviteCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []CopilotInviteRequest
+		wantErr bool
+	}{
+		{
+			name: "required columns",
+			csv:  "organization,team,username\nacme,platform,octocat\nacme,web,hubot\n",
+			want: []CopilotInviteRequest{
+				{Organization: "acme", Team: "platform", Username: "octocat"},
+				{Organization: "acme", Team: "web", Username: "hubot"},
+			},
+		},
+		{
+			name: "columns in any order with role and padding",
+			csv:  "Username, Role ,Organization,Team\n octocat ,maintainer, acme ,platform\n",
+			want: []CopilotInviteRequest{
+				{Organization: "acme", Team: "platform", Username: "octocat", Role: "maintainer"},
+			},
+		},
+		{
+			name: "header only",
+			csv:  "organization,team,username\n",
+			want: []CopilotInviteRequest{},
+		},
+		{
+			name: "empty",
+			csv:  "",
+		},
+		{
+			name:    "missing column",
+			csv:     "organization,username\nacme,octocat\n",
+			wantErr: true,
+		},
+		{
+			name:    "ragged row",
+			csv:     "organization,team,username\nacme,platform\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseInviteCSV(strings.NewReader(tt.csv))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseInviteCSV: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("invites = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindBulkInvites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	want := []CopilotInviteRequest{{Organization: "acme", Team: "platform", Username: "octocat"}}
+
+	var upload bytes.Buffer
+	form := multipart.NewWriter(&upload)
+	file, _ := form.CreateFormFile("file", "invites.csv")
+	file.Write([]byte("organization,team,username\nacme,platform,octocat\n"))
+	form.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "json", contentType: "application/json", body: `{"invites":[{"organization":"acme","team":"platform","username":"octocat"}]}`},
+		{name: "csv", contentType: "text/csv", body: "organization,team,username\nacme,platform,octocat\n"},
+		{name: "upload", contentType: form.FormDataContentType(), body: upload.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/copilot/invite/bulk", strings.NewReader(tt.body))
+			c.Request.Header.Set("Content-Type", tt.contentType)
+
+			got, err := bindBulkInvites(c)
+			if err != nil {
+				t.Fatalf("bindBulkInvites: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("invites = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package invite
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policy holds the optional requirements a user must meet to get a seat
+type Policy struct {
+	RequireSAML      bool // the user must have a linked SAML identity
+	RequireTwoFactor bool // the user must have two-factor authentication enabled
+}
+
+// Reason codes for an ineligible user
+const (
+	ReasonNotMember   = "not_org_member"
+	ReasonNoSAML      = "saml_identity_missing"
+	ReasonNoTwoFactor = "two_factor_disabled"
+	ReasonNotFound    = "user_not_found"
+)
+
+const (
+	membershipActive  = "active"
+	membershipPending = "pending"
+)
+
+// Reason explains why a user may not be given a seat
+type Reason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// IneligibleError is returned when a user does not meet the requirements for
+// a seat. No license is reserved for such a user.
+type IneligibleError struct {
+	Organization string
+	Username     string
+	Reasons      []Reason
+}
+
+func (e *IneligibleError) Error() string {
+	messages := make([]string, len(e.Reasons))
+	for i, reason := range e.Reasons {
+		messages[i] = reason.Message
+	}
+	return fmt.Sprintf("user %s is not eligible for a copilot seat in %s: %s", e.Username, e.Organization, strings.Join(messages, "; "))
+}
+
+// status is the batch status for the error
+func (e *IneligibleError) status() Status {
+	for _, reason := range e.Reasons {
+		if reason.Code == ReasonNotMember {
+			return StatusNotMember
+		}
+	}
+	return StatusIneligible
+}
+
+// NotFoundReasons are the reasons reported for a username that does not exist
+// on GitHub
+func NotFoundReasons() []Reason {
+	return []Reason{{Code: ReasonNotFound, Message: "no such GitHub user"}}
+}
+
+// SetPolicy sets the requirements checked before a seat is assigned
+func (s *Service) SetPolicy(policy Policy) {
+	s.policy = policy
+}
+
+// checkEligibility looks up a user and checks that they may hold a seat in
+// the organization: they must be a member or have a pending invitation, and
+// meet the policy. Every check is run so that all reasons are reported. The
+// error is github.ErrUserNotFound, an *IneligibleError or a lookup failure.
+func (s *Service) checkEligibility(org, username string) ([]Check, error) {
+	var checks []Check
+	if _, err := s.githubClient.GetUser(username); err != nil {
+		return append(checks, Check{Name: "user_exists", Detail: err.Error()}), err
+	}
+	checks = append(checks, Check{Name: "user_exists", Passed: true})
+
+	ineligible := &IneligibleError{Organization: org, Username: username}
+
+	state, err := s.githubClient.GetOrgMembershipState(org, username)
+	if err != nil {
+		return append(checks, Check{Name: "org_member", Detail: err.Error()}), err
+	}
+	if state == membershipActive || state == membershipPending {
+		checks = append(checks, Check{Name: "org_member", Passed: true, Detail: state})
+	} else {
+		reason := Reason{Code: ReasonNotMember, Message: "not a member of " + org + " and has no pending invitation"}
+		checks = append(checks, Check{Name: "org_member", Detail: reason.Message})
+		ineligible.Reasons = append(ineligible.Reasons, reason)
+	}
+
+	if s.policy.RequireSAML {
+		linked, err := s.githubClient.HasSAMLIdentity(org, username)
+		if err != nil {
+			return append(checks, Check{Name: "saml_identity", Detail: err.Error()}), err
+		}
+		if linked {
+			checks = append(checks, Check{Name: "saml_identity", Passed: true})
+		} else {
+			reason := Reason{Code: ReasonNoSAML, Message: "no linked SAML identity"}
+			checks = append(checks, Check{Name: "saml_identity", Detail: reason.Message})
+			ineligible.Reasons = append(ineligible.Reasons, reason)
+		}
+	}
+
+	// GitHub only reports two-factor status for members, so a pending
+	// invitation cannot be checked yet
+	if s.policy.RequireTwoFactor && state == membershipActive {
+		disabled, err := s.githubClient.TwoFactorDisabled(org, username)
+		if err != nil {
+			return append(checks, Check{Name: "two_factor", Detail: err.Error()}), err
+		}
+		if disabled {
+			reason := Reason{Code: ReasonNoTwoFactor, Message: "two-factor authentication is disabled"}
+			checks = append(checks, Check{Name: "two_factor", Detail: reason.Message})
+			ineligible.Reasons = append(ineligible.Reasons, reason)
+		} else {
+			checks = append(checks, Check{Name: "two_factor", Passed: true})
+		}
+	}
+
+	if len(ineligible.Reasons) > 0 {
+		return checks, ineligible
+	}
+	return checks, nil
+}
@@ -0,0 +1,141 @@
+package invite
+
+import (
+	"errors"
+	"fmt"
+
+	"github-copilot-invite/internal/github"
+)
+
+// Check is a single validation performed for a dry run
+type Check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Preview describes what an invite would do. Status is the status the invite
+// would end with if it were run now.
+type Preview struct {
+	Request
+	Status          Status   `json:"status"`
+	Checks          []Check  `json:"checks"`
+	Reasons         []Reason `json:"reasons,omitempty"`
+	ConsumesLicense bool     `json:"consumes_license"`
+}
+
+// Preview validates a single invite without assigning a seat or touching the
+// license store
+func (s *Service) Preview(req Request) (Preview, error) {
+	previews, err := s.PreviewBatch([]Request{req})
+	if err != nil {
+		return Preview{}, err
+	}
+	return previews[0], nil
+}
+
+// PreviewBatch validates a batch of invites the way InviteBatch would run
+// them, without assigning seats or reserving licenses. Licenses are counted
+// per organization across the whole batch, so an organization without enough
+// licenses for all of its entries previews as no-license, as it would run.
+// Users who already hold a seat preview as already-has-seat whatever the
+// licenses, as Invite and InviteBatch do not reserve one for them.
+func (s *Service) PreviewBatch(reqs []Request) ([]Preview, error) {
+	previews := make([]Preview, len(reqs))
+
+	byOrg := make(map[string][]int)
+	var orgs []string
+	seen := make(map[string]bool)
+	for i, req := range reqs {
+		previews[i] = s.preview(req)
+		if previews[i].Status != "" {
+			continue
+		}
+
+		key := req.Organization + "/" + req.Username
+		if seen[key] {
+			previews[i].Status = StatusError
+			previews[i].ConsumesLicense = false
+			previews[i].Checks = append(previews[i].Checks, Check{Name: "unique", Detail: "duplicate entry"})
+			continue
+		}
+		seen[key] = true
+
+		if !previews[i].ConsumesLicense {
+			previews[i].Status = StatusAlreadyHasSeat
+			continue
+		}
+		if _, exists := byOrg[req.Organization]; !exists {
+			orgs = append(orgs, req.Organization)
+		}
+		byOrg[req.Organization] = append(byOrg[req.Organization], i)
+	}
+
+	for _, org := range orgs {
+		available, err := s.licenses.Check(org)
+		if err != nil {
+			return nil, err
+		}
+
+		entries := byOrg[org]
+		check := Check{
+			Name:   "license_available",
+			Passed: available >= len(entries),
+			Detail: fmt.Sprintf("%d requested, %d available", len(entries), available),
+		}
+		for _, i := range entries {
+			previews[i].Checks = append(previews[i].Checks, check)
+			if check.Passed {
+				previews[i].Status = StatusAssigned
+			} else {
+				previews[i].Status = StatusNoLicense
+			}
+		}
+	}
+
+	return previews, nil
+}
+
+// preview runs the GitHub checks of a single invite. The status is left
+// empty if every check passed.
+func (s *Service) preview(req Request) Preview {
+	p := Preview{Request: req}
+
+	if err := req.validate(); err != nil {
+		p.Status = StatusError
+		p.Checks = append(p.Checks, Check{Name: "valid", Detail: err.Error()})
+		return p
+	}
+
+	checks, err := s.checkEligibility(req.Organization, req.Username)
+	p.Checks = checks
+	if err != nil {
+		p.Status, p.Reasons = classify(err)
+		return p
+	}
+
+	if _, err := s.githubClient.GetTeam(req.Organization, req.Team); err != nil {
+		p.Checks = append(p.Checks, Check{Name: "team_exists", Detail: err.Error()})
+		p.Status = StatusError
+		if errors.Is(err, github.ErrTeamNotFound) {
+			p.Status = StatusUnknownTeam
+		}
+		return p
+	}
+	p.Checks = append(p.Checks, Check{Name: "team_exists", Passed: true})
+
+	hasSeat, err := s.githubClient.HasCopilotSeat(req.Organization, req.Username)
+	if err != nil {
+		p.Checks = append(p.Checks, Check{Name: "copilot_seat", Detail: err.Error()})
+		p.Status = StatusError
+		return p
+	}
+	if hasSeat {
+		p.Checks = append(p.Checks, Check{Name: "copilot_seat", Passed: true, Detail: "already assigned"})
+		return p
+	}
+	p.Checks = append(p.Checks, Check{Name: "copilot_seat", Passed: true, Detail: "not assigned"})
+	p.ConsumesLicense = true
+
+	return p
+}
@@ -0,0 +1,605 @@
+package invite
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github-copilot-invite/internal/github"
+	"github-copilot-invite/internal/license"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Request asks for a Copilot seat for a user of an organization
+type Request struct {
+	Organization string `json:"organization" binding:"required"`
+	Team         string `json:"team" binding:"required"`
+	Username     string `json:"username" binding:"required"`
+	Role         string `json:"role,omitempty" binding:"omitempty,oneof=member maintainer"`
+}
+
+// validate checks a request that did not go through request binding, such
+// as a CSV row
+func (r Request) validate() error {
+	if r.Organization == "" || r.Team == "" || r.Username == "" {
+		return errors.New("organization, team and username are required")
+	}
+	if r.Role != "" && r.Role != "member" && r.Role != "maintainer" {
+		return errors.New("role must be member or maintainer")
+	}
+	return nil
+}
+
+// ValidateBatch checks the entries of a batch without calling GitHub. Invalid
+// and duplicate entries get an error result; the results of the other
+// entries are left without a status.
+func ValidateBatch(reqs []Request) []Result {
+	results := make([]Result, len(reqs))
+	seen := make(map[string]bool)
+	for i, req := range reqs {
+		results[i].Request = req
+
+		if err := req.validate(); err != nil {
+			results[i].Status = StatusError
+			results[i].Error = err.Error()
+			continue
+		}
+		key := req.Organization + "/" + req.Username
+		if seen[key] {
+			results[i].Status = StatusError
+			results[i].Error = "duplicate entry"
+			continue
+		}
+		seen[key] = true
+	}
+	return results
+}
+
+// Status is the outcome of a single invite within a batch
+type Status string
+
+const (
+	StatusAssigned       Status = "assigned"
+	StatusAlreadyHasSeat Status = "already-has-seat"
+	StatusNoLicense      Status = "no-license"
+	StatusUnknownUser    Status = "unknown-user"
+	StatusNotMember      Status = "not-member"
+	StatusIneligible     Status = "ineligible"
+	StatusUnknownTeam    Status = "unknown-team"
+	StatusUncoveredTeam  Status = "uncovered-team"
+	StatusError          Status = "error"
+)
+
+// Result is the outcome of a single invite
+type Result struct {
+	Request
+	Status     Status                        `json:"status"`
+	Assignment *github.CopilotSeatAssignment `json:"assignment,omitempty"`
+	Error      string                        `json:"error,omitempty"`
+	Reasons    []Reason                      `json:"reasons,omitempty"`
+}
+
+// Service assigns Copilot seats while keeping the license ledger in step
+type Service struct {
+	githubClient *github.Client
+	licenses     license.Store
+	policy       Policy
+	viaTeam      bool
+}
+
+// NewService creates a new invite service
+func NewService(githubClient *github.Client, licenses license.Store) *Service {
+	return &Service{
+		githubClient: githubClient,
+		licenses:     licenses,
+	}
+}
+
+// SetAssignViaTeam makes invites assign seats through the requested team
+// rather than to the user, so Copilot access follows team membership
+func (s *Service) SetAssignViaTeam(viaTeam bool) {
+	s.viaTeam = viaTeam
+}
+
+// Invite adds a user to the requested team and assigns them a Copilot seat.
+// The user is checked for eligibility first, so no license is spent on a
+// typo. A license is reserved while GitHub is called and committed once the
+// seat exists; if the commit fails the seat is cancelled again. A user who
+// already holds a seat needs no license, so they are added to the team even
+// if the organization has none left.
+func (s *Service) Invite(req Request) (*github.CopilotSeatAssignment, error) {
+	if _, err := s.checkEligibility(req.Organization, req.Username); err != nil {
+		return nil, err
+	}
+
+	hasSeat, err := s.githubClient.HasCopilotSeat(req.Organization, req.Username)
+	if err != nil {
+		return nil, err
+	}
+	if hasSeat {
+		return s.assignSeated(req)
+	}
+
+	// Hold a license while GitHub is called. The hold expires on its own if
+	// this request never gets to commit or release it.
+	reservation, err := s.licenses.Reserve(req.Organization, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	assignment, err := s.assign(req)
+	if err != nil {
+		s.release(reservation)
+		return nil, err
+	}
+
+	// A user who already holds a seat does not consume another license
+	if assignment.AlreadyAssigned {
+		s.release(reservation)
+		return assignment, nil
+	}
+
+	// Commit the license, or take the seat back if that fails
+	if err := s.licenses.Commit(reservation, 1); err != nil {
+		s.compensate([]*github.CopilotSeatAssignment{assignment}, err)
+		return nil, err
+	}
+
+	return assignment, nil
+}
+
+// InviteOne invites a single user and reports the outcome as a Result
+// instead of an error
+func (s *Service) InviteOne(req Request) Result {
+	result := Result{Request: req}
+
+	assignment, err := s.Invite(req)
+	switch {
+	case errors.Is(err, license.ErrNoLicenses), errors.Is(err, license.ErrLicenseTaken):
+		result.Status = StatusNoLicense
+		result.Error = err.Error()
+	case err != nil:
+		result.fail(err)
+	case assignment.AlreadyAssigned:
+		result.Status = StatusAlreadyHasSeat
+		result.Assignment = assignment
+	default:
+		result.Status = StatusAssigned
+		result.Assignment = assignment
+	}
+	return result
+}
+
+// fail records an error that stopped an invite before a seat was assigned
+func (r *Result) fail(err error) {
+	r.Status, r.Reasons = classify(err)
+	r.Error = err.Error()
+}
+
+// classify maps an error that stopped an invite to a status
+func classify(err error) (Status, []Reason) {
+	var ineligible *IneligibleError
+	var uncovered *UncoveredTeamError
+	switch {
+	case errors.Is(err, github.ErrUserNotFound):
+		return StatusUnknownUser, NotFoundReasons()
+	case errors.Is(err, github.ErrTeamNotFound):
+		return StatusUnknownTeam, nil
+	case errors.As(err, &uncovered):
+		return StatusUncoveredTeam, nil
+	case errors.As(err, &ineligible):
+		return ineligible.status(), ineligible.Reasons
+	default:
+		return StatusError, nil
+	}
+}
+
+// LicenseShortfall reports an organization without enough licenses for a
+// batch
+type LicenseShortfall struct {
+	Organization string `json:"organization"`
+	Requested    int    `json:"requested"`
+	Available    int    `json:"available"`
+}
+
+// CheckLicenses checks that every organization in a batch has enough
+// licenses for all of its valid entries. Nothing is reserved.
+func (s *Service) CheckLicenses(reqs []Request) ([]LicenseShortfall, error) {
+	requested := make(map[string]int)
+	var orgs []string
+	for _, result := range ValidateBatch(reqs) {
+		if result.Status != "" {
+			continue
+		}
+		req := result.Request
+		if _, exists := requested[req.Organization]; !exists {
+			orgs = append(orgs, req.Organization)
+		}
+		requested[req.Organization]++
+	}
+
+	var shortfalls []LicenseShortfall
+	for _, org := range orgs {
+		available, err := s.licenses.Check(org)
+		if err != nil {
+			return nil, err
+		}
+		if available < requested[org] {
+			shortfalls = append(shortfalls, LicenseShortfall{
+				Organization: org,
+				Requested:    requested[org],
+				Available:    available,
+			})
+		}
+	}
+	return shortfalls, nil
+}
+
+// InviteBatch assigns Copilot seats to a batch of users. Each organization's
+// licenses are reserved for all of its entries before any seat is assigned,
+// so an organization without enough licenses is skipped entirely rather than
+// half onboarded.
+func (s *Service) InviteBatch(reqs []Request) []Result {
+	results := ValidateBatch(reqs)
+
+	// Check the valid entries and group them by organization
+	byOrg := make(map[string][]int)
+	var orgs []string
+	for i, req := range reqs {
+		if results[i].Status != "" {
+			continue
+		}
+
+		if _, err := s.checkEligibility(req.Organization, req.Username); err != nil {
+			results[i].fail(err)
+			continue
+		}
+
+		if _, exists := byOrg[req.Organization]; !exists {
+			orgs = append(orgs, req.Organization)
+		}
+		byOrg[req.Organization] = append(byOrg[req.Organization], i)
+	}
+
+	for _, org := range orgs {
+		s.inviteOrg(org, reqs, byOrg[org], results)
+	}
+
+	return results
+}
+
+// inviteOrg invites the entries of one organization. Licenses are reserved
+// under a single reservation for the users who do not hold a seat yet; users
+// who do are invited without one. Each seat's license is committed as soon as
+// the seat is assigned, so a failure later in the batch only affects its own
+// entry.
+func (s *Service) inviteOrg(org string, reqs []Request, entries []int, results []Result) {
+	var seated, unseated []int
+	for _, i := range entries {
+		hasSeat, err := s.githubClient.HasCopilotSeat(org, reqs[i].Username)
+		switch {
+		case err != nil:
+			results[i].fail(err)
+		case hasSeat:
+			seated = append(seated, i)
+		default:
+			unseated = append(unseated, i)
+		}
+	}
+
+	s.inviteSeated(org, reqs, seated, results)
+	if len(unseated) == 0 {
+		return
+	}
+
+	reservation, err := s.licenses.Reserve(org, len(unseated))
+	if err != nil {
+		status := StatusError
+		if errors.Is(err, license.ErrNoLicenses) {
+			status = StatusNoLicense
+			err = fmt.Errorf("organization %s does not have %d licenses available", org, len(unseated))
+		}
+		for _, i := range unseated {
+			results[i].Status = status
+			results[i].Error = err.Error()
+		}
+		return
+	}
+
+	for _, i := range unseated {
+		s.assignReserved(reservation, &results[i])
+	}
+
+	// Give back what was not used
+	s.release(reservation)
+}
+
+// InviteReserved invites a user with a license from a reservation the caller
+// holds for the organization, as InviteBatch does for each of its entries.
+// The license is committed as soon as the seat is assigned; the caller
+// releases what is left of the reservation once it is done.
+func (s *Service) InviteReserved(req Request, reservation *license.Reservation) Result {
+	result := Result{Request: req}
+	if _, err := s.checkEligibility(req.Organization, req.Username); err != nil {
+		result.fail(err)
+		return result
+	}
+
+	s.assignReserved(reservation, &result)
+	return result
+}
+
+// assignReserved assigns the seat of an eligible user and commits its
+// license from the reservation, recording the outcome in result
+func (s *Service) assignReserved(reservation *license.Reservation, result *Result) {
+	// Keep the reservation alive however long the batch takes
+	if err := s.licenses.Extend(reservation); err != nil {
+		result.Status = StatusError
+		result.Error = fmt.Sprintf("license reservation lost: %v", err)
+		return
+	}
+
+	assignment, err := s.assign(result.Request)
+	if err != nil {
+		result.fail(err)
+		return
+	}
+
+	result.Assignment = assignment
+	if assignment.AlreadyAssigned {
+		result.Status = StatusAlreadyHasSeat
+		return
+	}
+
+	if err := s.licenses.Consume(reservation, 1); err != nil {
+		result.Status = StatusError
+		result.Error = fmt.Sprintf("seat cancelled, failed to commit license: %v", err)
+		s.compensate([]*github.CopilotSeatAssignment{assignment}, err)
+		return
+	}
+	result.Status = StatusAssigned
+}
+
+// inviteSeated invites the entries of users who already hold a seat, without
+// reserving licenses
+func (s *Service) inviteSeated(org string, reqs []Request, entries []int, results []Result) {
+	var charged []int
+	for _, i := range entries {
+		assignment, err := s.assign(reqs[i])
+		if err != nil {
+			results[i].fail(err)
+			continue
+		}
+
+		results[i].Assignment = assignment
+		if assignment.AlreadyAssigned {
+			results[i].Status = StatusAlreadyHasSeat
+			continue
+		}
+		results[i].Status = StatusAssigned
+		charged = append(charged, i)
+	}
+	if len(charged) == 0 {
+		return
+	}
+
+	assignments := make([]*github.CopilotSeatAssignment, len(charged))
+	for n, i := range charged {
+		assignments[n] = results[i].Assignment
+	}
+	if err := s.charge(org, assignments); err != nil {
+		for _, i := range charged {
+			results[i].Status = StatusError
+			results[i].Error = fmt.Sprintf("seat cancelled, failed to commit license: %v", err)
+		}
+	}
+}
+
+// assignSeated invites a user who already holds a seat, without reserving a
+// license
+func (s *Service) assignSeated(req Request) (*github.CopilotSeatAssignment, error) {
+	assignment, err := s.assign(req)
+	if err != nil {
+		return nil, err
+	}
+	if !assignment.AlreadyAssigned {
+		if err := s.charge(req.Organization, []*github.CopilotSeatAssignment{assignment}); err != nil {
+			return nil, err
+		}
+	}
+	return assignment, nil
+}
+
+// charge takes licenses for seats created for users who held a seat when
+// checked, which happens if it was cancelled in between. The seats are
+// cancelled again if no license can be taken.
+func (s *Service) charge(org string, assignments []*github.CopilotSeatAssignment) error {
+	reservation, err := s.licenses.Reserve(org, len(assignments))
+	if err == nil {
+		err = s.licenses.Commit(reservation, len(assignments))
+	}
+	if err != nil {
+		s.compensate(assignments, err)
+	}
+	return err
+}
+
+// chargeExtra takes licenses for seats a team assignment created for other
+// members, who must have joined the team after it was checked. Those seats
+// are not cancelled if no license can be taken, since they may be in use.
+func (s *Service) chargeExtra(org, team string, count int) {
+	reservation, err := s.licenses.Reserve(org, count)
+	if err == nil {
+		err = s.licenses.Commit(reservation, count)
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("org", org).
+			Str("team", team).
+			Int("seats", count).
+			Msg("Team assignment created seats for other members without licenses, they are not in the license ledger until reconciled")
+	}
+}
+
+// release gives back a reservation that was not needed. A reservation that
+// was used up or has expired is already gone.
+func (s *Service) release(reservation *license.Reservation) {
+	if err := s.licenses.Release(reservation); err != nil && !errors.Is(err, license.ErrReservationNotFound) {
+		log.Warn().Err(err).Str("reservation", reservation.ID).Msg("Failed to release license reservation")
+	}
+}
+
+// UncoveredTeamError is returned when assigning a seat through a team would
+// also create seats for other members of the team, which no license was
+// reserved for
+type UncoveredTeamError struct {
+	Organization string
+	Team         string
+	Members      []string
+}
+
+func (e *UncoveredTeamError) Error() string {
+	return fmt.Sprintf("team %s in %s has members without a copilot seat: %s", e.Team, e.Organization, strings.Join(e.Members, ", "))
+}
+
+// assign adds the user to the requested team and assigns their seat, either
+// directly or through the team. A membership the assignment created or
+// changed is undone if the seat cannot be assigned.
+func (s *Service) assign(req Request) (*github.CopilotSeatAssignment, error) {
+	if !s.viaTeam {
+		membership, err := s.githubClient.EnsureTeamMembership(req.Organization, req.Team, req.Username, req.Role)
+		if err != nil {
+			return nil, err
+		}
+		assignment, err := s.githubClient.SendCopilotInvite(req.Organization, req.Username)
+		if err != nil {
+			s.undoMembership(req.Organization, req.Username, membership)
+			return nil, err
+		}
+		assignment.TeamMembership = membership
+		return assignment, nil
+	}
+
+	// Joining a team that already has Copilot assigns the seat right away,
+	// so whether the user is new to Copilot has to be checked beforehand
+	hadSeat, err := s.githubClient.HasCopilotSeat(req.Organization, req.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the requested user's license is reserved, so the team must not
+	// bring seats for anyone else along
+	uncovered, err := s.uncoveredMembers(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(uncovered) > 0 {
+		return nil, &UncoveredTeamError{Organization: req.Organization, Team: req.Team, Members: uncovered}
+	}
+
+	membership, err := s.githubClient.EnsureTeamMembership(req.Organization, req.Team, req.Username, req.Role)
+	if err != nil {
+		return nil, err
+	}
+	assignment, err := s.githubClient.SendCopilotTeamInvite(req.Organization, req.Team)
+	if err != nil {
+		s.undoMembership(req.Organization, req.Username, membership)
+		return nil, err
+	}
+
+	extra := assignment.SeatsCreated
+	if !hadSeat {
+		extra--
+	}
+	if extra > 0 {
+		s.chargeExtra(req.Organization, req.Team, extra)
+	}
+
+	assignment.Username = req.Username
+	assignment.AlreadyAssigned = hadSeat
+	assignment.PendingInvitation = membership.State == "pending"
+	assignment.TeamMembership = membership
+	return assignment, nil
+}
+
+// uncoveredMembers returns the members of the requested team other than the
+// requested user who do not hold a seat
+func (s *Service) uncoveredMembers(req Request) ([]string, error) {
+	members, err := s.githubClient.ListTeamMembers(req.Organization, req.Team)
+	if err != nil {
+		return nil, err
+	}
+
+	var uncovered []string
+	for _, member := range members {
+		login := member.GetLogin()
+		if strings.EqualFold(login, req.Username) {
+			continue
+		}
+		hasSeat, err := s.githubClient.HasCopilotSeat(req.Organization, login)
+		if err != nil {
+			return nil, err
+		}
+		if !hasSeat {
+			uncovered = append(uncovered, login)
+		}
+	}
+	return uncovered, nil
+}
+
+// undoMembership removes a team membership the service created, or puts
+// back the role it changed. Memberships that existed before are left alone.
+func (s *Service) undoMembership(org, username string, membership *github.TeamMembership) {
+	var err error
+	switch {
+	case membership == nil:
+		return
+	case membership.Created:
+		err = s.githubClient.RemoveTeamMembership(org, membership.Team, username)
+	case membership.PreviousRole != "":
+		_, err = s.githubClient.EnsureTeamMembership(org, membership.Team, username, membership.PreviousRole)
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("org", org).
+			Str("team", membership.Team).
+			Str("username", username).
+			Msg("Failed to undo team membership, manual cleanup required")
+	}
+}
+
+// compensate cancels seats that were assigned without their license being
+// committed and undoes the team memberships the assignments created. A seat
+// assigned through a team is cancelled by removing the user from the team
+// again, which is only possible if the assignment added them to it.
+func (s *Service) compensate(assignments []*github.CopilotSeatAssignment, cause error) {
+	for _, assignment := range assignments {
+		org, username := assignment.Organization, assignment.Username
+		log.Error().
+			Err(cause).
+			Str("org", org).
+			Str("username", username).
+			Msg("Failed to commit license, cancelling seat")
+
+		membership := assignment.TeamMembership
+		switch {
+		case !s.viaTeam:
+			if _, err := s.githubClient.RevokeCopilotSeat(org, username); err != nil {
+				log.Error().
+					Err(err).
+					Str("org", org).
+					Str("username", username).
+					Msg("Failed to cancel seat after license commit failure, manual cleanup required")
+			}
+		case membership == nil || !membership.Created:
+			log.Error().
+				Str("org", org).
+				Str("username", username).
+				Msg("Seat was assigned through a team the user already belonged to, manual cleanup required")
+		}
+		s.undoMembership(org, username, membership)
+	}
+}
@@ -0,0 +1,600 @@
+package invite
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github-copilot-invite/internal/github"
+	"github-copilot-invite/internal/license"
+)
+
+const testOrg = "acme"
+
+// fakeGitHub is a local stand-in for the GitHub API of a single
+// organization. Every known user is an active member of it.
+type fakeGitHub struct {
+	t *testing.T
+
+	mu           sync.Mutex
+	users        map[string]bool
+	seats        map[string]bool            // users holding a seat of their own
+	teams        map[string]map[string]bool // team -> members
+	copilotTeams map[string]bool            // teams whose members get a seat
+	failAssign   map[string]bool            // users whose seat assignment fails
+	removed      []string                   // team/user memberships removed
+	assignDelay  time.Duration              // time each seat assignment takes
+
+	// lateJoiners are added to a team without a seat right before the team
+	// is given Copilot, as if they joined after it was checked
+	lateJoiners []string
+}
+
+func newFakeGitHub(t *testing.T, users ...string) *fakeGitHub {
+	f := &fakeGitHub{
+		t:            t,
+		users:        make(map[string]bool),
+		seats:        make(map[string]bool),
+		teams:        make(map[string]map[string]bool),
+		copilotTeams: make(map[string]bool),
+		failAssign:   make(map[string]bool),
+	}
+	for _, user := range users {
+		f.users[user] = true
+	}
+	return f
+}
+
+// addMember adds a user to a team, creating the team if needed
+func (f *fakeGitHub) addMember(team, user string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.addMemberLocked(team, user)
+}
+
+func (f *fakeGitHub) addMemberLocked(team, user string) {
+	if f.teams[team] == nil {
+		f.teams[team] = make(map[string]bool)
+	}
+	f.teams[team][user] = true
+}
+
+func (f *fakeGitHub) isMember(team, user string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.teams[team][user]
+}
+
+// hasSeat reports whether a user holds a seat, directly or through a team.
+// The caller must hold mu.
+func (f *fakeGitHub) hasSeat(user string) bool {
+	if f.seats[user] {
+		return true
+	}
+	for team := range f.copilotTeams {
+		if f.teams[team][user] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeGitHub) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{user}", f.getUser)
+	mux.HandleFunc("GET /orgs/acme/memberships/{user}", f.getOrgMembership)
+	mux.HandleFunc("GET /orgs/acme/members/{user}/copilot", f.getSeat)
+	mux.HandleFunc("GET /orgs/acme/teams/{team}/members", f.listTeamMembers)
+	mux.HandleFunc("GET /orgs/acme/teams/{team}/memberships/{user}", f.getTeamMembership)
+	mux.HandleFunc("PUT /orgs/acme/teams/{team}/memberships/{user}", f.addTeamMembership)
+	mux.HandleFunc("DELETE /orgs/acme/teams/{team}/memberships/{user}", f.removeTeamMembership)
+	mux.HandleFunc("POST /orgs/acme/copilot/billing/selected_users", f.addSeats)
+	mux.HandleFunc("DELETE /orgs/acme/copilot/billing/selected_users", f.removeSeats)
+	mux.HandleFunc("POST /orgs/acme/copilot/billing/selected_teams", f.addTeams)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+}
+
+func (f *fakeGitHub) getUser(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user := r.PathValue("user")
+	if !f.users[user] {
+		notFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"login": user})
+}
+
+func (f *fakeGitHub) getOrgMembership(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.users[r.PathValue("user")] {
+		notFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"state": "active"})
+}
+
+func (f *fakeGitHub) getSeat(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user := r.PathValue("user")
+	if !f.hasSeat(user) {
+		notFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"assignee": map[string]string{"login": user, "type": "User"}})
+}
+
+func (f *fakeGitHub) listTeamMembers(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	team, exists := f.teams[r.PathValue("team")]
+	if !exists {
+		notFound(w)
+		return
+	}
+	members := make([]map[string]string, 0, len(team))
+	for user := range team {
+		members = append(members, map[string]string{"login": user})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i]["login"] < members[j]["login"] })
+	writeJSON(w, http.StatusOK, members)
+}
+
+func (f *fakeGitHub) getTeamMembership(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.teams[r.PathValue("team")][r.PathValue("user")] {
+		notFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"role": "member", "state": "active"})
+}
+
+func (f *fakeGitHub) addTeamMembership(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	team := r.PathValue("team")
+	if _, exists := f.teams[team]; !exists {
+		notFound(w)
+		return
+	}
+	f.addMemberLocked(team, r.PathValue("user"))
+	writeJSON(w, http.StatusOK, map[string]string{"role": "member", "state": "active"})
+}
+
+func (f *fakeGitHub) removeTeamMembership(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	team, user := r.PathValue("team"), r.PathValue("user")
+	delete(f.teams[team], user)
+	f.removed = append(f.removed, team+"/"+user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGitHub) addSeats(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		SelectedUsernames []string `json:"selected_usernames"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	time.Sleep(f.assignDelay)
+	created := 0
+	for _, user := range body.SelectedUsernames {
+		if f.failAssign[user] {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "seat assignment failed"})
+			return
+		}
+		if !f.hasSeat(user) {
+			created++
+		}
+		f.seats[user] = true
+	}
+	writeJSON(w, http.StatusCreated, map[string]int{"seats_created": created})
+}
+
+func (f *fakeGitHub) removeSeats(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		SelectedUsernames []string `json:"selected_usernames"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cancelled := 0
+	for _, user := range body.SelectedUsernames {
+		if f.seats[user] {
+			cancelled++
+		}
+		delete(f.seats, user)
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"seats_cancelled": cancelled})
+}
+
+func (f *fakeGitHub) addTeams(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		SelectedTeams []string `json:"selected_teams"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	created := 0
+	for _, team := range body.SelectedTeams {
+		for _, user := range f.lateJoiners {
+			f.addMemberLocked(team, user)
+		}
+		for user := range f.teams[team] {
+			if !f.hasSeat(user) {
+				created++
+			}
+		}
+		f.copilotTeams[team] = true
+	}
+	writeJSON(w, http.StatusCreated, map[string]int{"seats_created": created})
+}
+
+// memBackend is an in-memory license backend. adjustErr, if set, makes
+// Adjust fail without applying the adjustment, either every time or only on
+// call number failAdjustAt.
+type memBackend struct {
+	mu           sync.Mutex
+	available    map[string]int
+	adjustErr    error
+	failAdjustAt int
+	adjustCalls  int
+}
+
+func (b *memBackend) List() ([]license.License, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var licenses []license.License
+	for org, available := range b.available {
+		licenses = append(licenses, license.License{Organization: org, Available: available})
+	}
+	return licenses, nil
+}
+
+func (b *memBackend) Available(org string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.available[org], nil
+}
+
+func (b *memBackend) Adjust(org string, delta int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.adjustCalls++
+	if b.adjustErr != nil && (b.failAdjustAt == 0 || b.failAdjustAt == b.adjustCalls) {
+		return b.adjustErr
+	}
+	if b.available[org]+delta < 0 {
+		return license.ErrNoLicenses
+	}
+	b.available[org] += delta
+	return nil
+}
+
+func (b *memBackend) SetAvailable(org string, available int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available[org] = available
+	return nil
+}
+
+func (b *memBackend) Refresh() error {
+	return nil
+}
+
+func (b *memBackend) availableFor(org string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.available[org]
+}
+
+// newTestService returns a service talking to a fake GitHub, with available
+// licenses for the test organization
+func newTestService(t *testing.T, gh *fakeGitHub, available int) (*Service, *memBackend) {
+	t.Helper()
+	return newTestServiceWithTTL(t, gh, available, time.Minute)
+}
+
+// newTestServiceWithTTL is newTestService with reservations expiring after ttl
+func newTestServiceWithTTL(t *testing.T, gh *fakeGitHub, available int, ttl time.Duration) (*Service, *memBackend) {
+	t.Helper()
+	server := httptest.NewServer(gh.handler())
+	t.Cleanup(server.Close)
+
+	client, err := github.NewClientWithBaseURL("test-token", server.URL)
+	if err != nil {
+		t.Fatalf("NewClientWithBaseURL: %v", err)
+	}
+	backend := &memBackend{available: map[string]int{testOrg: available}}
+	return NewService(client, license.NewLedger(backend, ttl)), backend
+}
+
+func TestInvite(t *testing.T) {
+	gh := newFakeGitHub(t, "octocat")
+	gh.addMember("platform", "hubot")
+	s, backend := newTestService(t, gh, 2)
+
+	assignment, err := s.Invite(Request{Organization: testOrg, Team: "platform", Username: "octocat"})
+	if err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	if assignment.AlreadyAssigned || !assignment.TeamMembership.Added {
+		t.Errorf("assignment = %+v, want a new seat and membership", assignment)
+	}
+	if got := backend.availableFor(testOrg); got != 1 {
+		t.Errorf("available = %d, want 1", got)
+	}
+}
+
+func TestInviteRollsBackMembershipWhenAssignFails(t *testing.T) {
+	gh := newFakeGitHub(t, "octocat")
+	gh.addMember("platform", "hubot")
+	gh.failAssign["octocat"] = true
+	s, backend := newTestService(t, gh, 2)
+
+	if _, err := s.Invite(Request{Organization: testOrg, Team: "platform", Username: "octocat"}); err == nil {
+		t.Fatal("expected the seat assignment to fail")
+	}
+	if gh.isMember("platform", "octocat") {
+		t.Error("octocat is still in the team the failed invite added them to")
+	}
+	if got := backend.availableFor(testOrg); got != 2 {
+		t.Errorf("available = %d, want 2", got)
+	}
+}
+
+func TestInviteKeepsExistingMembershipWhenAssignFails(t *testing.T) {
+	gh := newFakeGitHub(t, "octocat")
+	gh.addMember("platform", "octocat")
+	gh.failAssign["octocat"] = true
+	s, _ := newTestService(t, gh, 2)
+
+	if _, err := s.Invite(Request{Organization: testOrg, Team: "platform", Username: "octocat"}); err == nil {
+		t.Fatal("expected the seat assignment to fail")
+	}
+	if !gh.isMember("platform", "octocat") {
+		t.Error("octocat was removed from a team they belonged to before the invite")
+	}
+}
+
+func TestInviteCommitFailureCancelsSeat(t *testing.T) {
+	gh := newFakeGitHub(t, "octocat")
+	gh.addMember("platform", "hubot")
+	s, backend := newTestService(t, gh, 2)
+	backend.adjustErr = errors.New("sheet unavailable")
+
+	if _, err := s.Invite(Request{Organization: testOrg, Team: "platform", Username: "octocat"}); err == nil {
+		t.Fatal("expected the license commit to fail")
+	}
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	if gh.seats["octocat"] {
+		t.Error("seat was not cancelled after the license commit failed")
+	}
+	if gh.teams["platform"]["octocat"] {
+		t.Error("membership created by the invite was not removed")
+	}
+}
+
+func TestInviteViaTeamRefusesUncoveredMembers(t *testing.T) {
+	gh := newFakeGitHub(t, "octocat", "hubot")
+	gh.addMember("platform", "hubot")
+	s, backend := newTestService(t, gh, 5)
+	s.SetAssignViaTeam(true)
+
+	_, err := s.Invite(Request{Organization: testOrg, Team: "platform", Username: "octocat"})
+	var uncovered *UncoveredTeamError
+	if !errors.As(err, &uncovered) || len(uncovered.Members) != 1 || uncovered.Members[0] != "hubot" {
+		t.Fatalf("err = %v, want an UncoveredTeamError for hubot", err)
+	}
+	if gh.isMember("platform", "octocat") {
+		t.Error("octocat was added to a team that was refused")
+	}
+	if got := backend.availableFor(testOrg); got != 5 {
+		t.Errorf("available = %d, want 5", got)
+	}
+}
+
+func TestInviteViaTeamChargesLateJoiners(t *testing.T) {
+	gh := newFakeGitHub(t, "octocat", "hubot")
+	gh.addMember("platform", "hubot")
+	gh.seats["hubot"] = true
+	gh.lateJoiners = []string{"monalisa"}
+	s, backend := newTestService(t, gh, 5)
+	s.SetAssignViaTeam(true)
+
+	assignment, err := s.Invite(Request{Organization: testOrg, Team: "platform", Username: "octocat"})
+	if err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	if assignment.SeatsCreated != 2 {
+		t.Errorf("seats created = %d, want 2", assignment.SeatsCreated)
+	}
+	if got := backend.availableFor(testOrg); got != 3 {
+		t.Errorf("available = %d, want 3 after charging octocat and monalisa", got)
+	}
+}
+
+func TestInviteViaTeamCommitFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		member     bool // octocat was in the team before the invite
+		wantMember bool
+	}{
+		{name: "membership created", member: false, wantMember: false},
+		{name: "existing membership", member: true, wantMember: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gh := newFakeGitHub(t, "octocat")
+			gh.addMember("platform", "hubot")
+			gh.seats["hubot"] = true
+			if tt.member {
+				gh.addMember("platform", "octocat")
+			}
+			s, backend := newTestService(t, gh, 2)
+			s.SetAssignViaTeam(true)
+			backend.adjustErr = errors.New("sheet unavailable")
+
+			if _, err := s.Invite(Request{Organization: testOrg, Team: "platform", Username: "octocat"}); err == nil {
+				t.Fatal("expected the license commit to fail")
+			}
+			if got := gh.isMember("platform", "octocat"); got != tt.wantMember {
+				t.Errorf("member = %v, want %v", got, tt.wantMember)
+			}
+		})
+	}
+}
+
+func TestInviteBatchOutlastsReservationTTL(t *testing.T) {
+	users := []string{"user-1", "user-2", "user-3", "user-4"}
+	gh := newFakeGitHub(t, users...)
+	gh.addMember("platform", "hubot")
+	gh.assignDelay = 20 * time.Millisecond
+	s, backend := newTestServiceWithTTL(t, gh, 4, 50*time.Millisecond)
+
+	for _, result := range s.InviteBatch(batch(users...)) {
+		if result.Status != StatusAssigned {
+			t.Errorf("%s: status = %s (%s), want assigned", result.Username, result.Status, result.Error)
+		}
+	}
+	if got := backend.availableFor(testOrg); got != 0 {
+		t.Errorf("available = %d, want 0", got)
+	}
+}
+
+// batch returns requests for users of the test organization's platform team
+func batch(users ...string) []Request {
+	reqs := make([]Request, len(users))
+	for i, user := range users {
+		reqs[i] = Request{Organization: testOrg, Team: "platform", Username: user}
+	}
+	return reqs
+}
+
+func TestInviteBatch(t *testing.T) {
+	gh := newFakeGitHub(t, "user-1", "user-2", "seated", "broken")
+	gh.addMember("platform", "hubot")
+	gh.seats["seated"] = true
+	gh.failAssign["broken"] = true
+	s, backend := newTestService(t, gh, 3)
+
+	reqs := batch("user-1", "ghost", "seated", "broken", "user-2", "user-1")
+	reqs = append(reqs, Request{Organization: testOrg, Username: "no-team"})
+	want := []Status{
+		StatusAssigned,
+		StatusUnknownUser,
+		StatusAlreadyHasSeat,
+		StatusError,
+		StatusAssigned,
+		StatusError, // duplicate
+		StatusError, // invalid
+	}
+
+	results := s.InviteBatch(reqs)
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("%s: status = %s (%s), want %s", result.Username, result.Status, result.Error, want[i])
+		}
+	}
+	if reasons := results[1].Reasons; len(reasons) != 1 || reasons[0].Code != ReasonNotFound {
+		t.Errorf("unknown user reasons = %+v, want user_not_found", reasons)
+	}
+	if got := backend.availableFor(testOrg); got != 1 {
+		t.Errorf("available = %d, want 1", got)
+	}
+	if got := gh.isMember("platform", "broken"); got {
+		t.Error("membership of a failed entry was not rolled back")
+	}
+}
+
+func TestInviteBatchNotEnoughLicenses(t *testing.T) {
+	gh := newFakeGitHub(t, "user-1", "user-2", "seated")
+	gh.addMember("platform", "hubot")
+	gh.seats["seated"] = true
+	s, backend := newTestService(t, gh, 1)
+
+	results := s.InviteBatch(batch("user-1", "user-2", "seated"))
+	want := []Status{StatusNoLicense, StatusNoLicense, StatusAlreadyHasSeat}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("%s: status = %s, want %s", result.Username, result.Status, want[i])
+		}
+	}
+	if got := backend.availableFor(testOrg); got != 1 {
+		t.Errorf("available = %d, want 1", got)
+	}
+	if got := gh.isMember("platform", "user-1"); got {
+		t.Error("user-1 was added to the team without a license")
+	}
+}
+
+func TestInviteBatchLateCommitFailure(t *testing.T) {
+	gh := newFakeGitHub(t, "user-1", "user-2", "user-3")
+	gh.addMember("platform", "hubot")
+	s, backend := newTestService(t, gh, 3)
+	backend.adjustErr = errors.New("sheet unavailable")
+	backend.failAdjustAt = 3
+
+	results := s.InviteBatch(batch("user-1", "user-2", "user-3"))
+	want := []Status{StatusAssigned, StatusAssigned, StatusError}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("%s: status = %s (%s), want %s", result.Username, result.Status, result.Error, want[i])
+		}
+	}
+
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	for _, user := range []string{"user-1", "user-2"} {
+		if !gh.seats[user] {
+			t.Errorf("%s lost their seat to a later failure", user)
+		}
+	}
+	if gh.seats["user-3"] {
+		t.Error("user-3 kept a seat without a license")
+	}
+	if got := backend.availableFor(testOrg); got != 1 {
+		t.Errorf("available = %d, want 1", got)
+	}
+}
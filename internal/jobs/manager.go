@@ -0,0 +1,399 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github-copilot-invite/internal/invite"
+	"github-copilot-invite/internal/license"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Status is the state of an invite job
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+)
+
+// ItemPending marks a job item that has not been processed yet
+const ItemPending invite.Status = "pending"
+
+// Job is a batch of invites processed in the background
+type Job struct {
+	ID          string                `json:"id"`
+	Status      Status                `json:"status"`
+	CreatedAt   time.Time             `json:"created_at"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+	CompletedAt *time.Time            `json:"completed_at,omitempty"`
+	Total       int                   `json:"total"`
+	Processed   int                   `json:"processed"`
+	Summary     map[invite.Status]int `json:"summary"`
+	Items       []invite.Result       `json:"items"`
+
+	// revision counts the changes to the job so an older copy is never
+	// saved over a newer one
+	revision int
+}
+
+// Manager runs invite jobs with bounded concurrency and persists them to a
+// directory, one JSON file per job, so unfinished jobs resume after a restart
+type Manager struct {
+	invites   *invite.Service
+	licenses  license.Store
+	dir       string
+	sem       chan struct{}
+	retention time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+
+	// saveMu orders writes to the job files; saved holds the revision last
+	// written for each job
+	saveMu sync.Mutex
+	saved  map[string]int
+}
+
+// NewManager creates a job manager storing jobs in dir and running at most
+// concurrency invites at a time. Licenses for a job's invites are reserved
+// in licenses while it runs.
+func NewManager(invites *invite.Service, licenses license.Store, dir string, concurrency int) (*Manager, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating job directory: %v", err)
+	}
+
+	m := &Manager{
+		invites:  invites,
+		licenses: licenses,
+		dir:      dir,
+		sem:      make(chan struct{}, concurrency),
+		jobs:     make(map[string]*Job),
+		saved:    make(map[string]int),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetRetention sets how long completed jobs are kept. Older jobs are removed
+// along with their files; zero keeps them forever.
+func (m *Manager) SetRetention(retention time.Duration) {
+	m.retention = retention
+}
+
+// Resume restarts the jobs that were not completed before the last shutdown
+func (m *Manager) Resume() {
+	m.prune()
+
+	m.mu.Lock()
+	var pending []*Job
+	for _, job := range m.jobs {
+		if job.Status != StatusCompleted {
+			pending = append(pending, job)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, job := range pending {
+		log.Info().Str("job", job.ID).Int("remaining", job.Total-job.Processed).Msg("Resuming invite job")
+		go m.run(job)
+	}
+}
+
+// Submit queues a batch of invites and returns the new job. Invalid and
+// duplicate entries are recorded as failed items right away.
+func (m *Manager) Submit(reqs []invite.Request) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        id,
+		Status:    StatusQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Total:     len(reqs),
+		Summary:   make(map[invite.Status]int),
+		Items:     invite.ValidateBatch(reqs),
+	}
+	for i := range job.Items {
+		if job.Items[i].Status == "" {
+			job.Items[i].Status = ItemPending
+		} else {
+			job.Processed++
+		}
+		job.Summary[job.Items[i].Status]++
+	}
+
+	m.prune()
+
+	m.mu.Lock()
+	m.jobs[id] = job
+	job.revision++
+	snapshot := job.snapshot()
+	m.mu.Unlock()
+
+	if err := m.store(snapshot); err != nil {
+		m.mu.Lock()
+		delete(m.jobs, id)
+		m.mu.Unlock()
+		return nil, err
+	}
+
+	go m.run(job)
+	return snapshot, nil
+}
+
+// Get returns a copy of a job
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return nil, false
+	}
+	return job.snapshot(), true
+}
+
+// run processes the pending items of a job. Each organization's licenses are
+// reserved for all of its pending items before any seat is assigned, as for
+// a synchronous batch, and each license is committed as its seat is assigned.
+func (m *Manager) run(job *Job) {
+	pending := make(map[int]invite.Request)
+	var order []int
+	m.update(job, func() {
+		job.Status = StatusRunning
+		for i, item := range job.Items {
+			if item.Status == ItemPending {
+				pending[i] = item.Request
+				order = append(order, i)
+			}
+		}
+	})
+
+	byOrg := make(map[string][]int)
+	var orgs []string
+	for _, i := range order {
+		org := pending[i].Organization
+		if _, exists := byOrg[org]; !exists {
+			orgs = append(orgs, org)
+		}
+		byOrg[org] = append(byOrg[org], i)
+	}
+
+	var wg sync.WaitGroup
+	for _, org := range orgs {
+		items := byOrg[org]
+		reservation, err := m.licenses.Reserve(org, len(items))
+		if err != nil {
+			status := invite.StatusError
+			if errors.Is(err, license.ErrNoLicenses) {
+				status = invite.StatusNoLicense
+				err = fmt.Errorf("organization %s does not have %d licenses available", org, len(items))
+			}
+			for _, i := range items {
+				m.finish(job, i, invite.Result{Request: pending[i], Status: status, Error: err.Error()})
+			}
+			continue
+		}
+
+		var orgWG sync.WaitGroup
+		for _, i := range items {
+			m.sem <- struct{}{}
+			orgWG.Add(1)
+			go func(i int) {
+				defer func() {
+					<-m.sem
+					orgWG.Done()
+				}()
+				m.finish(job, i, m.invites.InviteReserved(pending[i], reservation))
+			}(i)
+		}
+
+		// Give back what was not used once the organization's items are done
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			orgWG.Wait()
+			if err := m.licenses.Release(reservation); err != nil && !errors.Is(err, license.ErrReservationNotFound) {
+				log.Error().Err(err).Str("job", job.ID).Str("organization", org).Msg("Failed to release job licenses")
+			}
+		}()
+	}
+	wg.Wait()
+
+	m.update(job, func() {
+		now := time.Now().UTC()
+		job.Status = StatusCompleted
+		job.CompletedAt = &now
+		delete(job.Summary, ItemPending)
+	})
+
+	log.Info().Str("job", job.ID).Int("total", job.Total).Msg("Invite job completed")
+}
+
+// finish records the result of a pending item
+func (m *Manager) finish(job *Job, i int, result invite.Result) {
+	m.update(job, func() {
+		job.Items[i] = result
+		job.Processed++
+		job.Summary[ItemPending]--
+		job.Summary[result.Status]++
+	})
+}
+
+// update applies a change to a job under mu and saves the result
+func (m *Manager) update(job *Job, change func()) {
+	m.mu.Lock()
+	change()
+	job.UpdatedAt = time.Now().UTC()
+	job.revision++
+	snapshot := job.snapshot()
+	m.mu.Unlock()
+
+	m.persist(snapshot)
+}
+
+// persist saves a copy of a job, logging failures
+func (m *Manager) persist(job *Job) {
+	if err := m.store(job); err != nil {
+		log.Error().Err(err).Str("job", job.ID).Msg("Failed to persist invite job")
+	}
+}
+
+// store saves a copy of a job unless a newer one was already saved
+func (m *Manager) store(job *Job) error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	if m.saved[job.ID] >= job.revision {
+		return nil
+	}
+	if err := m.save(job); err != nil {
+		return err
+	}
+	m.saved[job.ID] = job.revision
+	return nil
+}
+
+// prune removes the completed jobs older than the retention period
+func (m *Manager) prune() {
+	if m.retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-m.retention)
+
+	m.mu.Lock()
+	var expired []string
+	for id, job := range m.jobs {
+		if job.Status == StatusCompleted && job.CompletedAt != nil && job.CompletedAt.Before(cutoff) {
+			expired = append(expired, id)
+			delete(m.jobs, id)
+		}
+	}
+	m.mu.Unlock()
+
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	for _, id := range expired {
+		delete(m.saved, id)
+		if err := os.Remove(filepath.Join(m.dir, id+".json")); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("job", id).Msg("Failed to remove expired invite job")
+		}
+	}
+}
+
+// save writes a job to a temporary file and moves it into place. The caller
+// must hold saveMu.
+func (m *Manager) save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("error encoding job: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(m.dir, ".job-*.json")
+	if err != nil {
+		return fmt.Errorf("error creating job file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing job file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing job file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(m.dir, job.ID+".json")); err != nil {
+		return fmt.Errorf("error replacing job file: %v", err)
+	}
+	return nil
+}
+
+// load reads the persisted jobs from the job directory
+func (m *Manager) load() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return fmt.Errorf("error reading job directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(m.dir, name))
+		if err != nil {
+			return fmt.Errorf("error reading job file %s: %v", name, err)
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			log.Warn().Err(err).Str("file", name).Msg("Skipping unreadable job file")
+			continue
+		}
+		if job.Summary == nil {
+			job.Summary = make(map[invite.Status]int)
+		}
+		m.jobs[job.ID] = &job
+	}
+	return nil
+}
+
+// snapshot returns a deep copy of the job. The caller must hold mu.
+func (j *Job) snapshot() *Job {
+	copied := *j
+	copied.Items = append([]invite.Result(nil), j.Items...)
+	copied.Summary = make(map[invite.Status]int, len(j.Summary))
+	for status, count := range j.Summary {
+		copied.Summary[status] = count
+	}
+	return &copied
+}
+
+// newJobID returns a random job ID
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating job id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,397 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github-copilot-invite/internal/github"
+	"github-copilot-invite/internal/invite"
+	"github-copilot-invite/internal/license"
+)
+
+const testOrg = "acme"
+
+// fakeGitHub is a local stand-in for the GitHub API of a single organization
+// with one team. Every known user is an active member of the organization.
+type fakeGitHub struct {
+	mu      sync.Mutex
+	users   map[string]bool
+	seats   map[string]bool
+	members map[string]bool
+
+	// block, if set, holds every seat assignment until it is closed
+	block chan struct{}
+}
+
+func newFakeGitHub(users ...string) *fakeGitHub {
+	f := &fakeGitHub{
+		users:   make(map[string]bool),
+		seats:   make(map[string]bool),
+		members: make(map[string]bool),
+	}
+	for _, user := range users {
+		f.users[user] = true
+	}
+	return f
+}
+
+func (f *fakeGitHub) hasSeat(user string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.seats[user]
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+}
+
+func (f *fakeGitHub) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{user}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.users[r.PathValue("user")] {
+			notFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"login": r.PathValue("user")})
+	})
+	mux.HandleFunc("GET /orgs/acme/memberships/{user}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.users[r.PathValue("user")] {
+			notFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"state": "active"})
+	})
+	mux.HandleFunc("GET /orgs/acme/members/{user}/copilot", func(w http.ResponseWriter, r *http.Request) {
+		if !f.hasSeat(r.PathValue("user")) {
+			notFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"assignee": map[string]string{"login": r.PathValue("user"), "type": "User"}})
+	})
+	mux.HandleFunc("GET /orgs/acme/teams/platform/memberships/{user}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.members[r.PathValue("user")] {
+			notFound(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"role": "member", "state": "active"})
+	})
+	mux.HandleFunc("PUT /orgs/acme/teams/platform/memberships/{user}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.members[r.PathValue("user")] = true
+		writeJSON(w, http.StatusOK, map[string]string{"role": "member", "state": "active"})
+	})
+	mux.HandleFunc("POST /orgs/acme/copilot/billing/selected_users", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			SelectedUsernames []string `json:"selected_usernames"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if f.block != nil {
+			<-f.block
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		created := 0
+		for _, user := range body.SelectedUsernames {
+			if !f.seats[user] {
+				created++
+			}
+			f.seats[user] = true
+		}
+		writeJSON(w, http.StatusCreated, map[string]int{"seats_created": created})
+	})
+	return mux
+}
+
+// memBackend is an in-memory license backend
+type memBackend struct {
+	mu        sync.Mutex
+	available map[string]int
+}
+
+func (b *memBackend) List() ([]license.License, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var licenses []license.License
+	for org, available := range b.available {
+		licenses = append(licenses, license.License{Organization: org, Available: available})
+	}
+	return licenses, nil
+}
+
+func (b *memBackend) Available(org string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.available[org], nil
+}
+
+func (b *memBackend) Adjust(org string, delta int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.available[org]+delta < 0 {
+		return license.ErrNoLicenses
+	}
+	b.available[org] += delta
+	return nil
+}
+
+func (b *memBackend) SetAvailable(org string, available int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available[org] = available
+	return nil
+}
+
+func (b *memBackend) Refresh() error {
+	return nil
+}
+
+// newTestManager returns a manager storing jobs in dir, inviting through a
+// fake GitHub with available licenses for the test organization
+func newTestManager(t *testing.T, gh *fakeGitHub, dir string, available int) (*Manager, *license.Ledger, *memBackend) {
+	t.Helper()
+	server := httptest.NewServer(gh.handler())
+	t.Cleanup(server.Close)
+
+	client, err := github.NewClientWithBaseURL("test-token", server.URL)
+	if err != nil {
+		t.Fatalf("NewClientWithBaseURL: %v", err)
+	}
+	backend := &memBackend{available: map[string]int{testOrg: available}}
+	ledger := license.NewLedger(backend, time.Minute)
+
+	m, err := NewManager(invite.NewService(client, ledger), ledger, dir, 2)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	return m, ledger, backend
+}
+
+// wait polls a job until it is completed
+func wait(t *testing.T, m *Manager, id string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, exists := m.Get(id)
+		if !exists {
+			t.Fatalf("job %s not found", id)
+		}
+		if job.Status == StatusCompleted {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not complete", id)
+	return nil
+}
+
+// readJob reads a job's file from dir
+func readJob(t *testing.T, dir, id string) *Job {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		t.Fatalf("reading job file: %v", err)
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		t.Fatalf("decoding job file: %v", err)
+	}
+	return &job
+}
+
+func requests(users ...string) []invite.Request {
+	reqs := make([]invite.Request, len(users))
+	for i, user := range users {
+		reqs[i] = invite.Request{Organization: testOrg, Team: "platform", Username: user}
+	}
+	return reqs
+}
+
+func TestJobCommitsLicenses(t *testing.T) {
+	dir := t.TempDir()
+	gh := newFakeGitHub("octocat", "hubot")
+	m, ledger, backend := newTestManager(t, gh, dir, 3)
+
+	submitted, err := m.Submit(append(requests("octocat", "hubot", "ghost"), invite.Request{Organization: testOrg, Username: "octocat"}))
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	job := wait(t, m, submitted.ID)
+
+	if job.Processed != 4 || job.Summary[invite.StatusAssigned] != 2 || job.Summary[invite.StatusUnknownUser] != 1 || job.Summary[invite.StatusError] != 1 {
+		t.Errorf("job = %+v, want 2 assigned, 1 unknown and 1 rejected", job)
+	}
+	if !gh.hasSeat("octocat") || !gh.hasSeat("hubot") {
+		t.Error("seats were not assigned")
+	}
+	if got, _ := backend.Available(testOrg); got != 1 {
+		t.Errorf("available = %d, want 1", got)
+	}
+	if got := ledger.Reservations(); len(got) != 0 {
+		t.Errorf("Reservations() = %+v after the job, want none", got)
+	}
+
+	// The last save happens after the job is marked completed
+	saved := readJob(t, dir, job.ID)
+	for deadline := time.Now().Add(5 * time.Second); saved.Status != StatusCompleted && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		saved = readJob(t, dir, job.ID)
+	}
+	if saved.Status != StatusCompleted || saved.Processed != 4 {
+		t.Errorf("saved job = %+v, want the completed job", saved)
+	}
+}
+
+func TestJobHoldsLicensesWhileRunning(t *testing.T) {
+	gh := newFakeGitHub("octocat", "hubot")
+	gh.block = make(chan struct{})
+	m, ledger, _ := newTestManager(t, gh, t.TempDir(), 3)
+
+	submitted, err := m.Submit(requests("octocat", "hubot"))
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	// A synchronous invite started meanwhile only sees what the job left
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ledger.Reservations()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, _ := ledger.Check(testOrg); got != 1 {
+		t.Errorf("Check = %d while the job runs, want 1", got)
+	}
+
+	close(gh.block)
+	if job := wait(t, m, submitted.ID); job.Summary[invite.StatusAssigned] != 2 {
+		t.Errorf("summary = %v, want 2 assigned", job.Summary)
+	}
+}
+
+func TestJobNoLicenses(t *testing.T) {
+	gh := newFakeGitHub("octocat", "hubot")
+	m, _, backend := newTestManager(t, gh, t.TempDir(), 1)
+
+	submitted, err := m.Submit(requests("octocat", "hubot"))
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	job := wait(t, m, submitted.ID)
+
+	if job.Summary[invite.StatusNoLicense] != 2 {
+		t.Errorf("summary = %v, want 2 without a license", job.Summary)
+	}
+	if gh.hasSeat("octocat") || gh.hasSeat("hubot") {
+		t.Error("a seat was assigned without a license")
+	}
+	if got, _ := backend.Available(testOrg); got != 1 {
+		t.Errorf("available = %d, want 1", got)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	gh := newFakeGitHub("octocat", "hubot")
+	m, _, _ := newTestManager(t, gh, dir, 2)
+
+	// A job interrupted after its first item
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        "interrupted",
+		Status:    StatusRunning,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Total:     2,
+		Processed: 1,
+		Summary:   map[invite.Status]int{invite.StatusAssigned: 1, ItemPending: 1},
+		Items: []invite.Result{
+			{Request: requests("octocat")[0], Status: invite.StatusAssigned},
+			{Request: requests("hubot")[0], Status: ItemPending},
+		},
+	}
+	if err := m.save(job); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	resumed, _, _ := newTestManager(t, gh, dir, 2)
+	resumed.Resume()
+	job = wait(t, resumed, "interrupted")
+
+	if job.Processed != 2 || job.Summary[invite.StatusAssigned] != 2 {
+		t.Errorf("job = %+v, want both items assigned", job)
+	}
+	if gh.hasSeat("octocat") {
+		t.Error("the item processed before the restart was invited again")
+	}
+	if !gh.hasSeat("hubot") {
+		t.Error("the pending item was not invited")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	gh := newFakeGitHub()
+	m, _, _ := newTestManager(t, gh, dir, 0)
+
+	completed := func(id string, at time.Time) {
+		if err := m.save(&Job{ID: id, Status: StatusCompleted, CompletedAt: &at, Summary: map[invite.Status]int{}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	completed("old", time.Now().Add(-48*time.Hour))
+	completed("recent", time.Now().Add(-time.Hour))
+
+	m, _, _ = newTestManager(t, gh, dir, 0)
+	m.SetRetention(24 * time.Hour)
+	m.Resume()
+
+	if _, exists := m.Get("old"); exists {
+		t.Error("a job past the retention period was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.json")); !os.IsNotExist(err) {
+		t.Errorf("stat old job file: %v, want it removed", err)
+	}
+	if _, exists := m.Get("recent"); !exists {
+		t.Error("a job within the retention period was removed")
+	}
+}
+
+func TestStoreSkipsStaleRevision(t *testing.T) {
+	dir := t.TempDir()
+	m, _, _ := newTestManager(t, newFakeGitHub(), dir, 0)
+
+	newer := &Job{ID: "job", Status: StatusCompleted, Processed: 2, revision: 3}
+	older := &Job{ID: "job", Status: StatusRunning, Processed: 1, revision: 2}
+	if err := m.store(newer); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if err := m.store(older); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if saved := readJob(t, dir, "job"); saved.Status != StatusCompleted || saved.Processed != 2 {
+		t.Errorf("saved job = %+v, want the newer revision", saved)
+	}
+}
@@ -0,0 +1,233 @@
+package license
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var csvHeader = []string{"organization", "available", "purchased", "cost_center"}
+
+// CSVBackend keeps the license ledger in a local CSV file with the header
+// organization,available,purchased,cost_center. The file is re-read before
+// every write so hand edits are picked up, but writers in other processes
+// are not coordinated; run a single instance against one file.
+type CSVBackend struct {
+	path string
+
+	mu       sync.Mutex
+	licenses map[string]*License
+}
+
+// NewCSVBackend creates a backend for the given CSV file
+func NewCSVBackend(path string) *CSVBackend {
+	return &CSVBackend{
+		path: path,
+	}
+}
+
+func (b *CSVBackend) List() ([]License, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	licenses := make([]License, 0, len(b.licenses))
+	for _, license := range b.licenses {
+		licenses = append(licenses, *license)
+	}
+	sort.Slice(licenses, func(i, j int) bool {
+		return licenses[i].Organization < licenses[j].Organization
+	})
+	return licenses, nil
+}
+
+func (b *CSVBackend) Available(org string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.licenses == nil {
+		if err := b.load(); err != nil {
+			return 0, err
+		}
+	}
+
+	license, exists := b.licenses[org]
+	if !exists {
+		return 0, nil
+	}
+	return license.Available, nil
+}
+
+func (b *CSVBackend) Adjust(org string, delta int) error {
+	return b.update(org, func(available int) (int, error) {
+		if available+delta < 0 {
+			return 0, ErrNoLicenses
+		}
+		return available + delta, nil
+	})
+}
+
+func (b *CSVBackend) SetAvailable(org string, available int) error {
+	return b.update(org, func(int) (int, error) {
+		return available, nil
+	})
+}
+
+func (b *CSVBackend) Refresh() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.load()
+}
+
+// update applies change to an organization's available count and writes the
+// file back
+func (b *CSVBackend) update(org string, change func(available int) (int, error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.load(); err != nil {
+		return err
+	}
+
+	license, exists := b.licenses[org]
+	if !exists {
+		return fmt.Errorf("unknown org: %s", org)
+	}
+
+	available, err := change(license.Available)
+	if err != nil {
+		return err
+	}
+
+	previous := license.Available
+	license.Available = available
+	if err := b.save(); err != nil {
+		license.Available = previous
+		return err
+	}
+	return nil
+}
+
+// load reads the CSV file into memory
+func (b *CSVBackend) load() error {
+	file, err := os.Open(b.path)
+	if err != nil {
+		return fmt.Errorf("error opening license file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading license file header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range csvHeader[:2] {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("license file %s has no %q column", b.path, required)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	licenses := make(map[string]*License)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading license file: %v", err)
+		}
+
+		org := field(record, "organization")
+		if org == "" {
+			continue
+		}
+		available, err := strconv.Atoi(field(record, "available"))
+		if err != nil {
+			return fmt.Errorf("invalid available licenses for org %s: %v", org, err)
+		}
+		license := &License{
+			Organization: org,
+			Available:    available,
+			CostCenter:   field(record, "cost_center"),
+		}
+		if purchased := field(record, "purchased"); purchased != "" {
+			if license.Purchased, err = strconv.Atoi(purchased); err != nil {
+				return fmt.Errorf("invalid purchased licenses for org %s: %v", org, err)
+			}
+		}
+		licenses[org] = license
+	}
+
+	b.licenses = licenses
+	return nil
+}
+
+// save writes the ledger to a temporary file and moves it over the CSV
+// file, so readers never see a partial write
+func (b *CSVBackend) save() error {
+	orgs := make([]string, 0, len(b.licenses))
+	for org := range b.licenses {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), ".licenses-*.csv")
+	if err != nil {
+		return fmt.Errorf("error creating license file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// Keep the permissions of the existing file
+	if info, err := os.Stat(b.path); err == nil {
+		tmp.Chmod(info.Mode())
+	}
+
+	writer := csv.NewWriter(tmp)
+	writer.Write(csvHeader)
+	for _, org := range orgs {
+		license := b.licenses[org]
+		purchased := ""
+		if license.Purchased > 0 {
+			purchased = strconv.Itoa(license.Purchased)
+		}
+		writer.Write([]string{org, strconv.Itoa(license.Available), purchased, license.CostCenter})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing license file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing license file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		return fmt.Errorf("error replacing license file: %v", err)
+	}
+	return nil
+}
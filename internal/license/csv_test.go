@@ -0,0 +1,129 @@
+package license
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeCSV writes a license file and returns its path
+func writeCSV(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "licenses.csv")
+	if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatalf("writing license file: %v", err)
+	}
+	return path
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	path := writeCSV(t, "Organization, Available,Purchased,Cost_Center\nglobex,2,,\nacme,5,10,CC-1\n")
+	b := NewCSVBackend(path)
+
+	if err := b.Adjust("acme", -2); err != nil {
+		t.Fatalf("Adjust: %v", err)
+	}
+	if err := b.SetAvailable("globex", 4); err != nil {
+		t.Fatalf("SetAvailable: %v", err)
+	}
+
+	// A fresh backend reads back what was written, other columns untouched
+	got, err := NewCSVBackend(path).List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []License{
+		{Organization: "acme", Available: 3, Purchased: 10, CostCenter: "CC-1"},
+		{Organization: "globex", Available: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("licenses = %+v, want %+v", got, want)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading license file: %v", err)
+	}
+	if wantFile := "organization,available,purchased,cost_center\nacme,3,10,CC-1\nglobex,4,,\n"; string(data) != wantFile {
+		t.Errorf("file = %q, want %q", data, wantFile)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("file mode = %v, want 0640 kept", info.Mode().Perm())
+	}
+}
+
+func TestCSVPicksUpHandEdits(t *testing.T) {
+	path := writeCSV(t, "organization,available\nacme,5\n")
+	b := NewCSVBackend(path)
+	if got, _ := b.Available("acme"); got != 5 {
+		t.Fatalf("available = %d, want 5", got)
+	}
+
+	if err := os.WriteFile(path, []byte("organization,available\nacme,1\n"), 0640); err != nil {
+		t.Fatalf("writing license file: %v", err)
+	}
+	if err := b.Adjust("acme", -2); !errors.Is(err, ErrNoLicenses) {
+		t.Errorf("err = %v, want ErrNoLicenses after the file was edited", err)
+	}
+}
+
+func TestCSVErrors(t *testing.T) {
+	b := NewCSVBackend(writeCSV(t, "organization,available\nacme,1\n"))
+	if err := b.Adjust("acme", -2); !errors.Is(err, ErrNoLicenses) {
+		t.Errorf("err = %v, want ErrNoLicenses", err)
+	}
+	if err := b.Adjust("initech", 1); err == nil || !strings.Contains(err.Error(), "unknown org") {
+		t.Errorf("err = %v, want an unknown org error", err)
+	}
+	if got, _ := b.Available("initech"); got != 0 {
+		t.Errorf("available = %d for an unknown org, want 0", got)
+	}
+
+	for name, content := range map[string]string{
+		"missing column":   "organization,purchased\nacme,1\n",
+		"invalid count":    "organization,available\nacme,many\n",
+		"invalid purchase": "organization,available,purchased\nacme,1,x\n",
+	} {
+		if _, err := NewCSVBackend(writeCSV(t, content)).List(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := NewCSVBackend(filepath.Join(t.TempDir(), "missing.csv")).List(); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestCSVConcurrentAdjust(t *testing.T) {
+	b := NewCSVBackend(writeCSV(t, "organization,available\nacme,10\n"))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.Adjust("acme", -1)
+			if err != nil && !errors.Is(err, ErrNoLicenses) {
+				t.Errorf("Adjust: %v", err)
+			}
+			if err == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if taken != 10 {
+		t.Errorf("%d licenses taken, want 10", taken)
+	}
+	if got, _ := NewCSVBackend(b.path).Available("acme"); got != 0 {
+		t.Errorf("available = %d, want 0", got)
+	}
+}
@@ -0,0 +1,302 @@
+package license
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Ledger implements Store on top of a Backend. Reservations are held in
+// memory and only committed licenses are written to the backend, so a
+// reservation disappears when it expires or when the process dies.
+type Ledger struct {
+	backend Backend
+	ttl     time.Duration
+
+	mu           sync.Mutex
+	reservations map[string]*Reservation
+	held         map[string]int       // org -> reserved licenses
+	unsettled    map[string]time.Time // org -> last update with an unknown outcome
+}
+
+// NewLedger creates a new ledger whose reservations expire after ttl
+func NewLedger(backend Backend, ttl time.Duration) *Ledger {
+	return &Ledger{
+		backend:      backend,
+		ttl:          ttl,
+		reservations: make(map[string]*Reservation),
+		held:         make(map[string]int),
+		unsettled:    make(map[string]time.Time),
+	}
+}
+
+func (l *Ledger) Check(org string) (int, error) {
+	available, err := l.backend.Available(org)
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	return available - l.held[org], nil
+}
+
+func (l *Ledger) Reserve(org string, count int) (*Reservation, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("invalid license count: %d", count)
+	}
+
+	available, err := l.backend.Available(org)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	if available-l.held[org] < count {
+		return nil, ErrNoLicenses
+	}
+
+	id, err := newReservationID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	r := &Reservation{
+		ID:           id,
+		Organization: org,
+		Count:        count,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(l.ttl),
+	}
+	l.reservations[id] = r
+	l.held[org] += count
+
+	return r, nil
+}
+
+func (l *Ledger) Commit(r *Reservation, count int) error {
+	if count < 0 || count > r.Count {
+		return fmt.Errorf("invalid license count %d for reservation of %d", count, r.Count)
+	}
+
+	if err := l.remove(r); err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return nil
+	}
+	return l.settle(r.Organization, l.backend.Adjust(r.Organization, -count))
+}
+
+func (l *Ledger) Consume(r *Reservation, count int) error {
+	if count <= 0 {
+		return fmt.Errorf("invalid license count: %d", count)
+	}
+
+	l.mu.Lock()
+	l.expire()
+	held, exists := l.reservations[r.ID]
+	switch {
+	case !exists:
+		l.mu.Unlock()
+		return ErrReservationNotFound
+	case count > held.Count:
+		l.mu.Unlock()
+		return fmt.Errorf("invalid license count %d for reservation of %d", count, held.Count)
+	}
+
+	// Drop the consumed part of the hold; the backend takes over from here
+	held.Count -= count
+	l.held[held.Organization] -= count
+	if l.held[held.Organization] <= 0 {
+		delete(l.held, held.Organization)
+	}
+	if held.Count == 0 {
+		delete(l.reservations, held.ID)
+	}
+	l.mu.Unlock()
+
+	return l.settle(r.Organization, l.backend.Adjust(r.Organization, -count))
+}
+
+func (l *Ledger) Release(r *Reservation) error {
+	return l.remove(r)
+}
+
+func (l *Ledger) Extend(r *Reservation) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	held, exists := l.reservations[r.ID]
+	if !exists {
+		return ErrReservationNotFound
+	}
+	held.ExpiresAt = time.Now().UTC().Add(l.ttl)
+	return nil
+}
+
+func (l *Ledger) Reservations() []Reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	reservations := make([]Reservation, 0, len(l.reservations))
+	for _, r := range l.reservations {
+		reservations = append(reservations, *r)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].CreatedAt.Before(reservations[j].CreatedAt)
+	})
+	return reservations
+}
+
+func (l *Ledger) Return(org string, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	return l.settle(org, l.backend.Adjust(org, count))
+}
+
+func (l *Ledger) List() ([]License, error) {
+	return l.backend.List()
+}
+
+func (l *Ledger) SetAvailable(org string, available int) error {
+	return l.settle(org, l.backend.SetAvailable(org, available))
+}
+
+func (l *Ledger) Refresh() error {
+	return l.backend.Refresh()
+}
+
+func (l *Ledger) Unsettled() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	orgs := make([]string, 0, len(l.unsettled))
+	for org := range l.unsettled {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	return orgs
+}
+
+func (l *Ledger) Settle(org string, before time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if marked, exists := l.unsettled[org]; exists && marked.Before(before) {
+		delete(l.unsettled, org)
+	}
+}
+
+// settle handles the result of a backend update. An update with an unknown
+// outcome is treated as applied and the organization is marked for
+// reconciliation.
+func (l *Ledger) settle(org string, err error) error {
+	if !errors.Is(err, ErrOutcomeUnknown) {
+		return err
+	}
+
+	log.Error().
+		Err(err).
+		Str("org", org).
+		Msg("License update outcome unknown, leaving it to the reconciler")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.unsettled[org] = time.Now()
+	return nil
+}
+
+// StartRefresher reloads the backend every interval, with up to 10% jitter
+// so replicas do not hit it in lockstep, until the returned stop function is
+// called
+func (l *Ledger) StartRefresher(interval time.Duration) func() {
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			jitter := time.Duration(mathrand.Int63n(int64(interval)/10 + 1))
+			timer := time.NewTimer(interval + jitter)
+			select {
+			case <-timer.C:
+				if err := l.backend.Refresh(); err != nil {
+					log.Warn().Err(err).Msg("Background license refresh failed")
+				}
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+
+	log.Info().
+		Dur("interval", interval).
+		Msg("Started background license refresh")
+
+	return func() { close(done) }
+}
+
+// remove drops a reservation and its hold on the organization's licenses
+func (l *Ledger) remove(r *Reservation) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	if _, exists := l.reservations[r.ID]; !exists {
+		return ErrReservationNotFound
+	}
+
+	l.drop(r)
+	return nil
+}
+
+// expire drops reservations past their expiry. The caller must hold mu.
+func (l *Ledger) expire() {
+	now := time.Now()
+	for _, r := range l.reservations {
+		if now.After(r.ExpiresAt) {
+			log.Warn().
+				Str("reservation", r.ID).
+				Str("org", r.Organization).
+				Int("count", r.Count).
+				Msg("License reservation expired")
+			l.drop(r)
+		}
+	}
+}
+
+// drop removes a reservation and its hold. The caller must hold mu.
+func (l *Ledger) drop(r *Reservation) {
+	delete(l.reservations, r.ID)
+	l.held[r.Organization] -= r.Count
+	if l.held[r.Organization] <= 0 {
+		delete(l.held, r.Organization)
+	}
+}
+
+// newReservationID returns a random reservation ID
+func newReservationID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating reservation id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,303 @@
+package license
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBackend is an in-memory Backend. adjustErr, if set, is returned by
+// Adjust after the adjustment was applied.
+type memBackend struct {
+	mu        sync.Mutex
+	available map[string]int
+	adjustErr error
+}
+
+func newMemBackend(available map[string]int) *memBackend {
+	return &memBackend{available: available}
+}
+
+func (b *memBackend) List() ([]License, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	licenses := make([]License, 0, len(b.available))
+	for org, available := range b.available {
+		licenses = append(licenses, License{Organization: org, Available: available})
+	}
+	return licenses, nil
+}
+
+func (b *memBackend) Available(org string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.available[org], nil
+}
+
+func (b *memBackend) Adjust(org string, delta int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.available[org]+delta < 0 {
+		return ErrNoLicenses
+	}
+	b.available[org] += delta
+	return b.adjustErr
+}
+
+func (b *memBackend) SetAvailable(org string, available int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available[org] = available
+	return nil
+}
+
+func (b *memBackend) Refresh() error {
+	return nil
+}
+
+func TestCommitOutcomeUnknown(t *testing.T) {
+	backend := newMemBackend(map[string]int{"acme": 2})
+	backend.adjustErr = ErrOutcomeUnknown
+	ledger := NewLedger(backend, time.Minute)
+
+	r, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := ledger.Commit(r, 1); err != nil {
+		t.Errorf("Commit: %v, want the update treated as applied", err)
+	}
+	if got := ledger.Unsettled(); len(got) != 1 || got[0] != "acme" {
+		t.Errorf("Unsettled() = %v, want [acme]", got)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	backend := newMemBackend(map[string]int{"acme": 2})
+	backend.adjustErr = ErrOutcomeUnknown
+	ledger := NewLedger(backend, time.Minute)
+
+	before := time.Now()
+	if err := ledger.Return("acme", 1); err != nil {
+		t.Fatalf("Return: %v", err)
+	}
+
+	// A reconciler that read the ledger before the update must not settle it
+	ledger.Settle("acme", before)
+	if got := ledger.Unsettled(); len(got) != 1 {
+		t.Errorf("Unsettled() = %v after settling an older read, want [acme]", got)
+	}
+
+	ledger.Settle("acme", time.Now().Add(time.Millisecond))
+	if got := ledger.Unsettled(); len(got) != 0 {
+		t.Errorf("Unsettled() = %v, want none", got)
+	}
+}
+
+func TestCommitBackendError(t *testing.T) {
+	backend := newMemBackend(map[string]int{"acme": 2})
+	backend.adjustErr = errors.New("sheet unavailable")
+	ledger := NewLedger(backend, time.Minute)
+
+	r, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := ledger.Commit(r, 1); err == nil {
+		t.Error("expected the backend error")
+	}
+	if got := ledger.Unsettled(); len(got) != 0 {
+		t.Errorf("Unsettled() = %v, want none", got)
+	}
+}
+
+func TestReserveAndCommit(t *testing.T) {
+	backend := newMemBackend(map[string]int{"acme": 3})
+	ledger := NewLedger(backend, time.Minute)
+
+	r, err := ledger.Reserve("acme", 2)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if got, _ := ledger.Check("acme"); got != 1 {
+		t.Errorf("Check = %d while 2 are reserved, want 1", got)
+	}
+
+	// Committing part of a reservation releases the rest
+	if err := ledger.Commit(r, 1); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if got, _ := backend.Available("acme"); got != 2 {
+		t.Errorf("backend available = %d, want 2", got)
+	}
+	if got, _ := ledger.Check("acme"); got != 2 {
+		t.Errorf("Check = %d after commit, want 2", got)
+	}
+	if err := ledger.Commit(r, 1); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("second Commit err = %v, want ErrReservationNotFound", err)
+	}
+}
+
+func TestReserveInvalidCount(t *testing.T) {
+	ledger := NewLedger(newMemBackend(map[string]int{"acme": 3}), time.Minute)
+	if _, err := ledger.Reserve("acme", 0); err == nil {
+		t.Error("expected an error reserving no licenses")
+	}
+}
+
+func TestCommitMoreThanReserved(t *testing.T) {
+	ledger := NewLedger(newMemBackend(map[string]int{"acme": 3}), time.Minute)
+	r, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := ledger.Commit(r, 2); err == nil {
+		t.Error("expected an error committing more than was reserved")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	backend := newMemBackend(map[string]int{"acme": 3})
+	ledger := NewLedger(backend, time.Minute)
+
+	r, err := ledger.Reserve("acme", 3)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := ledger.Release(r); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got, _ := ledger.Check("acme"); got != 3 {
+		t.Errorf("Check = %d after release, want 3", got)
+	}
+	if got, _ := backend.Available("acme"); got != 3 {
+		t.Errorf("backend available = %d, want 3", got)
+	}
+	if got := ledger.Reservations(); len(got) != 0 {
+		t.Errorf("Reservations() = %+v, want none", got)
+	}
+}
+
+func TestOverlappingReservations(t *testing.T) {
+	ledger := NewLedger(newMemBackend(map[string]int{"acme": 3, "globex": 1}), time.Minute)
+
+	first, err := ledger.Reserve("acme", 2)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if _, err := ledger.Reserve("acme", 2); !errors.Is(err, ErrNoLicenses) {
+		t.Errorf("err = %v reserving more than is left, want ErrNoLicenses", err)
+	}
+	second, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	// Another organization's licenses are held separately
+	if _, err := ledger.Reserve("globex", 1); err != nil {
+		t.Errorf("Reserve(globex): %v", err)
+	}
+
+	if got := ledger.Reservations(); len(got) != 3 {
+		t.Errorf("%d reservations, want 3", len(got))
+	}
+	if err := ledger.Release(first); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got, _ := ledger.Check("acme"); got != 2 {
+		t.Errorf("Check = %d with one license still reserved, want 2", got)
+	}
+	if err := ledger.Commit(second, 1); err != nil {
+		t.Errorf("Commit: %v", err)
+	}
+}
+
+func TestReservationExpiry(t *testing.T) {
+	backend := newMemBackend(map[string]int{"acme": 1})
+	ledger := NewLedger(backend, 20*time.Millisecond)
+
+	r, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	if got, _ := ledger.Check("acme"); got != 1 {
+		t.Errorf("Check = %d after expiry, want 1", got)
+	}
+	if err := ledger.Commit(r, 1); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("err = %v, want ErrReservationNotFound", err)
+	}
+	if got, _ := backend.Available("acme"); got != 1 {
+		t.Errorf("backend available = %d, want 1", got)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	ledger := NewLedger(newMemBackend(map[string]int{"acme": 1}), 50*time.Millisecond)
+
+	r, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	// Each wait is shorter than the TTL, together they are longer
+	for i := 0; i < 3; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if err := ledger.Extend(r); err != nil {
+			t.Fatalf("Extend: %v", err)
+		}
+	}
+	if err := ledger.Commit(r, 1); err != nil {
+		t.Errorf("Commit: %v", err)
+	}
+}
+
+func TestExtendExpired(t *testing.T) {
+	ledger := NewLedger(newMemBackend(map[string]int{"acme": 1}), 10*time.Millisecond)
+
+	r, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := ledger.Extend(r); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("err = %v, want ErrReservationNotFound", err)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	backend := newMemBackend(map[string]int{"acme": 3})
+	ledger := NewLedger(backend, time.Minute)
+
+	r, err := ledger.Reserve("acme", 2)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := ledger.Consume(r, 1); err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	if got, _ := backend.Available("acme"); got != 2 {
+		t.Errorf("backend available = %d, want 2", got)
+	}
+	// The other license is still held
+	if got, _ := ledger.Check("acme"); got != 1 {
+		t.Errorf("Check = %d, want 1", got)
+	}
+	if err := ledger.Consume(r, 2); err == nil {
+		t.Error("expected an error consuming more than is left")
+	}
+
+	if err := ledger.Consume(r, 1); err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	if got := ledger.Reservations(); len(got) != 0 {
+		t.Errorf("Reservations() = %+v after consuming all of it, want none", got)
+	}
+	if err := ledger.Release(r); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("err = %v, want ErrReservationNotFound", err)
+	}
+}
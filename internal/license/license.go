@@ -0,0 +1,81 @@
+package license
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoLicenses          = errors.New("no licenses available")
+	ErrLicenseTaken        = errors.New("license was taken by a concurrent update")
+	ErrReservationNotFound = errors.New("reservation not found or expired")
+
+	// ErrOutcomeUnknown is returned by a Backend when an update may or may
+	// not have been applied. The Ledger does not pass it on, since undoing
+	// the work the update paid for could lose a license; it marks the
+	// organization for reconciliation instead.
+	ErrOutcomeUnknown = errors.New("license update outcome unknown")
+)
+
+// License is an organization's entry in the license ledger
+type License struct {
+	Organization string `json:"organization"`
+	Available    int    `json:"available"`
+	Purchased    int    `json:"purchased,omitempty"` // 0 when the ledger does not track it
+	CostCenter   string `json:"cost_center,omitempty"`
+}
+
+// Reservation holds licenses of an organization until it is committed,
+// released or expires
+type Reservation struct {
+	ID           string    `json:"id"`
+	Organization string    `json:"organization"`
+	Count        int       `json:"count"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Store is the license ledger used by the handlers
+type Store interface {
+	// Check returns the number of licenses an organization can still reserve
+	Check(org string) (int, error)
+	// Reserve holds count licenses of an organization
+	Reserve(org string, count int) (*Reservation, error)
+	// Commit consumes count licenses of a reservation and releases the rest
+	Commit(r *Reservation, count int) error
+	// Consume consumes count licenses of a reservation and keeps holding the
+	// rest, for callers that commit a batch one seat at a time
+	Consume(r *Reservation, count int) error
+	// Release gives a reservation back without consuming any license
+	Release(r *Reservation) error
+	// Extend renews a reservation's expiry, for callers that hold it across
+	// many calls to GitHub
+	Extend(r *Reservation) error
+	// Reservations returns the outstanding reservations
+	Reservations() []Reservation
+	// Return gives consumed licenses back, e.g. after a seat was cancelled
+	Return(org string, count int) error
+	// List returns the licenses of every organization
+	List() ([]License, error)
+	// SetAvailable overwrites the available licenses of an organization
+	SetAvailable(org string, available int) error
+	// Refresh reloads the ledger from its backend
+	Refresh() error
+	// Unsettled returns the organizations whose license count may be off
+	// because an update had an unknown outcome
+	Unsettled() []string
+	// Settle clears an organization's unsettled mark if it was set before
+	// the given time, i.e. before the reconciler read the ledger
+	Settle(org string, before time.Time)
+}
+
+// Backend persists the license ledger. Adjust must fail with ErrNoLicenses
+// rather than let the available count drop below zero, and with
+// ErrOutcomeUnknown when it cannot tell whether its write was applied.
+type Backend interface {
+	List() ([]License, error)
+	Available(org string) (int, error)
+	Adjust(org string, delta int) error
+	SetAvailable(org string, available int) error
+	Refresh() error
+}
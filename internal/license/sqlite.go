@@ -0,0 +1,115 @@
+package license
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS licenses (
+	organization TEXT PRIMARY KEY,
+	available    INTEGER NOT NULL DEFAULT 0,
+	purchased    INTEGER NOT NULL DEFAULT 0,
+	cost_center  TEXT NOT NULL DEFAULT ''
+)`
+
+// SQLiteBackend keeps the license ledger in an embedded SQLite database. The
+// driver is pure Go, so no cgo toolchain is needed. Updates are single
+// conditional statements, so several processes can share one database file.
+type SQLiteBackend struct {
+	db *sql.DB
+}
+
+// NewSQLiteBackend opens the database file, creating the licenses table if
+// it does not exist yet
+func NewSQLiteBackend(path string) (*SQLiteBackend, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening license database: %v", err)
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating licenses table: %v", err)
+	}
+
+	return &SQLiteBackend{db: db}, nil
+}
+
+func (b *SQLiteBackend) List() ([]License, error) {
+	rows, err := b.db.Query(`SELECT organization, available, purchased, cost_center FROM licenses ORDER BY organization`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing licenses: %v", err)
+	}
+	defer rows.Close()
+
+	var licenses []License
+	for rows.Next() {
+		var license License
+		if err := rows.Scan(&license.Organization, &license.Available, &license.Purchased, &license.CostCenter); err != nil {
+			return nil, fmt.Errorf("error reading licenses: %v", err)
+		}
+		licenses = append(licenses, license)
+	}
+	return licenses, rows.Err()
+}
+
+func (b *SQLiteBackend) Available(org string) (int, error) {
+	var available int
+	err := b.db.QueryRow(`SELECT available FROM licenses WHERE organization = ?`, org).Scan(&available)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading licenses for org %s: %v", org, err)
+	}
+	return available, nil
+}
+
+func (b *SQLiteBackend) Adjust(org string, delta int) error {
+	result, err := b.db.Exec(
+		`UPDATE licenses SET available = available + ? WHERE organization = ? AND available + ? >= 0`,
+		delta, org, delta,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating licenses for org %s: %v", org, err)
+	}
+	return b.checkUpdated(result, org, ErrNoLicenses)
+}
+
+func (b *SQLiteBackend) SetAvailable(org string, available int) error {
+	result, err := b.db.Exec(`UPDATE licenses SET available = ? WHERE organization = ?`, available, org)
+	if err != nil {
+		return fmt.Errorf("error updating licenses for org %s: %v", org, err)
+	}
+	return b.checkUpdated(result, org, nil)
+}
+
+// Refresh is a no-op, the database is always read directly
+func (b *SQLiteBackend) Refresh() error {
+	return nil
+}
+
+// checkUpdated tells an unknown organization apart from an update that was
+// rejected by its condition
+func (b *SQLiteBackend) checkUpdated(result sql.Result, org string, rejected error) error {
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error updating licenses for org %s: %v", org, err)
+	}
+	if updated > 0 {
+		return nil
+	}
+
+	var exists bool
+	if err := b.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM licenses WHERE organization = ?)`, org).Scan(&exists); err != nil {
+		return fmt.Errorf("error reading licenses for org %s: %v", org, err)
+	}
+	if !exists {
+		return fmt.Errorf("unknown org: %s", org)
+	}
+	return rejected
+}
@@ -0,0 +1,113 @@
+package license
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestSQLite opens a database in a temporary directory holding licenses
+// for acme and globex, and returns its path
+func newTestSQLite(t *testing.T) (*SQLiteBackend, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "licenses.db")
+	b := openTestSQLite(t, path)
+	if _, err := b.db.Exec(`INSERT INTO licenses (organization, available, purchased, cost_center) VALUES ('acme', 5, 10, 'CC-1'), ('globex', 2, 0, '')`); err != nil {
+		t.Fatalf("inserting licenses: %v", err)
+	}
+	return b, path
+}
+
+func openTestSQLite(t *testing.T, path string) *SQLiteBackend {
+	t.Helper()
+	b, err := NewSQLiteBackend(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteBackend: %v", err)
+	}
+	t.Cleanup(func() { b.db.Close() })
+	return b
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	b, path := newTestSQLite(t)
+
+	if err := b.Adjust("acme", -2); err != nil {
+		t.Fatalf("Adjust: %v", err)
+	}
+	if err := b.SetAvailable("globex", 4); err != nil {
+		t.Fatalf("SetAvailable: %v", err)
+	}
+
+	// Reopening the file reads back what was written
+	got, err := openTestSQLite(t, path).List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []License{
+		{Organization: "acme", Available: 3, Purchased: 10, CostCenter: "CC-1"},
+		{Organization: "globex", Available: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("licenses = %+v, want %+v", got, want)
+	}
+}
+
+func TestSQLiteErrors(t *testing.T) {
+	b, _ := newTestSQLite(t)
+
+	if err := b.Adjust("globex", -3); !errors.Is(err, ErrNoLicenses) {
+		t.Errorf("err = %v, want ErrNoLicenses", err)
+	}
+	if got, _ := b.Available("globex"); got != 2 {
+		t.Errorf("available = %d after a rejected update, want 2", got)
+	}
+	if err := b.Adjust("initech", 1); err == nil || !strings.Contains(err.Error(), "unknown org") {
+		t.Errorf("err = %v, want an unknown org error", err)
+	}
+	if err := b.SetAvailable("initech", 1); err == nil || !strings.Contains(err.Error(), "unknown org") {
+		t.Errorf("err = %v, want an unknown org error", err)
+	}
+	if got, err := b.Available("initech"); err != nil || got != 0 {
+		t.Errorf("Available = %d, %v for an unknown org, want 0", got, err)
+	}
+}
+
+func TestSQLiteConcurrentAdjust(t *testing.T) {
+	first, path := newTestSQLite(t)
+	// A second handle on the file stands in for another process
+	second := openTestSQLite(t, path)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 20; i++ {
+		b := first
+		if i%2 == 1 {
+			b = second
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.Adjust("acme", -1)
+			if err != nil && !errors.Is(err, ErrNoLicenses) {
+				t.Errorf("Adjust: %v", err)
+			}
+			if err == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if taken != 5 {
+		t.Errorf("%d licenses taken, want 5", taken)
+	}
+	if got, _ := first.Available("acme"); got != 0 {
+		t.Errorf("available = %d, want 0", got)
+	}
+}
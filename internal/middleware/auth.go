@@ -4,23 +4,32 @@ import (
 	"net/http"
 	"strings"
 
-	"github-copilot-invite/internal/config"
+	"github-copilot-invite/internal/auth"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 )
 
-// BearerAuth middleware validates the bearer token in the Authorization header
-func BearerAuth() gin.HandlerFunc {
+const (
+	// ClientKey is the context key holding the name of the authenticated client
+	ClientKey = "client"
+	// IdentityKey is the context key holding the authenticated *auth.Client
+	IdentityKey = "identity"
+)
+
+// BearerAuth middleware authenticates a request by its verified TLS client
+// certificate if it belongs to a registered API client. Otherwise it validates
+// the bearer token in the Authorization header against the credentials, then
+// as a JWT from the identity provider if one is configured. Secrets are held
+// in memory by the credentials, so no request reads the configuration.
+func BearerAuth(credentials *auth.Credentials, verifier *auth.Verifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get configuration manager
-		configMgr, err := config.NewManager("config.yaml")
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to create config manager")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"error": "Internal server error",
-			})
-			return
+		// The TLS handshake already verified the chain and revocation
+		if tls := c.Request.TLS; tls != nil && len(tls.PeerCertificates) > 0 {
+			if client, ok := credentials.AuthenticateCertificate(tls.PeerCertificates[0]); ok {
+				authenticated(c, client, "certificate")
+				return
+			}
 		}
 
 		// Get the Authorization header
@@ -42,24 +51,77 @@ func BearerAuth() gin.HandlerFunc {
 		}
 
 		token := parts[1]
-		expectedToken := configMgr.GetDecrypted("api.token")
+		if client, ok := credentials.Authenticate(token); ok {
+			authenticated(c, client, "token")
+			return
+		}
 
-		// Validate the token
-		if expectedToken == "" {
+		if verifier != nil && strings.Count(token, ".") == 2 {
+			client, err := verifier.Authenticate(token)
+			if err != nil {
+				log.Debug().Err(err).Msg("Rejected JWT")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error": "Invalid token",
+				})
+				return
+			}
+			authenticated(c, client, "jwt")
+			return
+		}
+
+		if !credentials.Configured() && verifier == nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 				"error": "API token not configured",
 			})
 			return
 		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": "Invalid token",
+		})
+	}
+}
 
-		if token != expectedToken {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid token",
+// authenticated records the client of a request and proceeds with it
+func authenticated(c *gin.Context, client *auth.Client, method string) {
+	c.Set(ClientKey, client.Name)
+	c.Set(IdentityKey, client)
+	log.Debug().
+		Str("client", client.Name).
+		Str("auth", method).
+		Str("method", c.Request.Method).
+		Str("path", c.Request.URL.Path).
+		Msg("Authenticated request")
+	c.Next()
+}
+
+// RequireScope middleware rejects clients that were not granted a scope, or
+// that may not act on the organization named in the route
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client := Identity(c)
+		if client == nil || !client.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Client is missing the " + scope + " scope",
 			})
 			return
 		}
 
-		// Token is valid, proceed with the request
+		if org := c.Param("org"); org != "" && !client.AllowsOrg(org) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Client may not act on organization " + org,
+			})
+			return
+		}
 		c.Next()
 	}
 }
+
+// Identity returns the authenticated client of a request
+func Identity(c *gin.Context) *auth.Client {
+	value, exists := c.Get(IdentityKey)
+	if !exists {
+		return nil
+	}
+	client, _ := value.(*auth.Client)
+	return client
+}
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header carrying the idempotency key
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	defaultIdempotencyWindow = 24 * time.Hour
+)
+
+// idempotentResponse is a stored response for an idempotency key
+type idempotentResponse struct {
+	key         string
+	requestHash string
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// idempotencyStore holds the responses by key. Every entry lives for the
+// same window, so entries expire in the order they were added and are
+// dropped from the front of that order.
+type idempotencyStore struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	order     []*idempotentResponse
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		window:    window,
+		responses: make(map[string]*idempotentResponse),
+	}
+}
+
+// claim returns the entry stored for key, or stores and returns a new
+// in-progress entry for the request. The caller must hold mu.
+func (s *idempotencyStore) claim(key, requestHash string, now time.Time) (*idempotentResponse, bool) {
+	s.expire(now)
+	if stored, exists := s.responses[key]; exists {
+		return stored, true
+	}
+
+	stored := &idempotentResponse{
+		key:         key,
+		requestHash: requestHash,
+		expiresAt:   now.Add(s.window),
+	}
+	s.responses[key] = stored
+	s.order = append(s.order, stored)
+	return stored, false
+}
+
+// expire drops the entries that expired before now. The caller must hold mu.
+func (s *idempotencyStore) expire(now time.Time) {
+	n := 0
+	for n < len(s.order) && now.After(s.order[n].expiresAt) {
+		if stored := s.order[n]; s.responses[stored.key] == stored {
+			delete(s.responses, stored.key)
+		}
+		s.order[n] = nil
+		n++
+	}
+	s.order = s.order[n:]
+}
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency middleware replays the first response to a request carrying an
+// Idempotency-Key header when the same client retries it within the
+// configured window (idempotency.window, default 24h). Reusing a key with a
+// different request is rejected. Requests without the header, dry runs and
+// 5xx responses are not stored.
+//
+// Keys are kept in memory by each instance, so a retry is only recognized
+// when it reaches the instance that served the first request. Deployments
+// with several replicas need sticky routing per client for the guarantee to
+// hold.
+func Idempotency() gin.HandlerFunc {
+	window := viper.GetDuration("idempotency.window")
+	if window <= 0 {
+		window = defaultIdempotencyWindow
+	}
+	return idempotency(newIdempotencyStore(window))
+}
+
+func idempotency(store *idempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// A dry run changes nothing, so it is not stored and leaves the key
+		// free for the real request
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if dryRun, _ := strconv.ParseBool(c.Query("dry_run")); key == "" || dryRun {
+			c.Next()
+			return
+		}
+
+		// Hash the request so a reused key with a different body is caught
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Failed to read request body",
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		storeKey := c.GetString(ClientKey) + "\x00" + key
+
+		store.mu.Lock()
+		stored, exists := store.claim(storeKey, requestHash, time.Now())
+		// Copy the entry while locked, the first request may be finishing
+		previous := *stored
+		store.mu.Unlock()
+		if exists {
+			switch {
+			case previous.requestHash != requestHash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+					"error": "Idempotency-Key was already used for a different request",
+				})
+			case !previous.done:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"error": "A request with this Idempotency-Key is still in progress",
+				})
+			default:
+				log.Debug().Str("key", key).Msg("Replaying idempotent response")
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(previous.status, previous.contentType, previous.body)
+				c.Abort()
+			}
+			return
+		}
+
+		// Drop the in-progress entry unless the response gets stored, so a
+		// handler that panics does not block retries for the whole window
+		defer func() {
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			if !stored.done && store.responses[storeKey] == stored {
+				delete(store.responses, storeKey)
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		// Let server errors be retried
+		if writer.Status() >= http.StatusInternalServerError {
+			return
+		}
+
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		stored.done = true
+		stored.status = writer.Status()
+		stored.contentType = writer.Header().Get("Content-Type")
+		stored.body = writer.body.Bytes()
+	}
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newIdempotentRouter serves POST /invite behind the idempotency middleware,
+// counting the calls that reach the handler. A request with ?wait=1 blocks
+// until release is closed.
+func newIdempotentRouter(store *idempotencyStore, calls *int32, release chan struct{}) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/invite", func(c *gin.Context) {
+		c.Set(ClientKey, "ci")
+	}, idempotency(store), func(c *gin.Context) {
+		n := atomic.AddInt32(calls, 1)
+		if c.Query("wait") != "" {
+			<-release
+		}
+		c.JSON(http.StatusCreated, gin.H{"call": n})
+	})
+	return router
+}
+
+func post(router http.Handler, target, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	var calls int32
+	router := newIdempotentRouter(newIdempotencyStore(time.Hour), &calls, nil)
+
+	first := post(router, "/invite", "key-1", `{"username":"octocat"}`)
+	second := post(router, "/invite", "key-1", `{"username":"octocat"}`)
+
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response is not marked")
+	}
+
+	// Requests without a key always reach the handler
+	post(router, "/invite", "", `{"username":"octocat"}`)
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	store := newIdempotencyStore(time.Hour)
+	router := newIdempotentRouter(store, &calls, release)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- post(router, "/invite?wait=1", "key-1", `{}`)
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if w := post(router, "/invite?wait=1", "key-1", `{}`); w.Code != http.StatusConflict {
+		t.Errorf("status = %d while the first request runs, want 409", w.Code)
+	}
+	close(release)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Errorf("first request status = %d, want 201", w.Code)
+	}
+}
+
+func TestIdempotencyMismatch(t *testing.T) {
+	var calls int32
+	router := newIdempotentRouter(newIdempotencyStore(time.Hour), &calls, nil)
+
+	post(router, "/invite", "key-1", `{"username":"octocat"}`)
+	if w := post(router, "/invite", "key-1", `{"username":"hubot"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d for a different body, want 422", w.Code)
+	}
+	// The query string is part of the request
+	if w := post(router, "/invite?dry_run=false", "key-1", `{"username":"octocat"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d for a different query, want 422", w.Code)
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	var calls int32
+	store := newIdempotencyStore(20 * time.Millisecond)
+	router := newIdempotentRouter(store, &calls, nil)
+
+	post(router, "/invite", "key-1", `{}`)
+	post(router, "/invite", "key-2", `{}`)
+	time.Sleep(40 * time.Millisecond)
+
+	if w := post(router, "/invite", "key-1", `{}`); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("an expired response was replayed")
+	}
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.responses) != 1 || len(store.order) != 1 {
+		t.Errorf("%d responses and %d ordered entries kept, want only the new one", len(store.responses), len(store.order))
+	}
+}
@@ -0,0 +1,222 @@
+package reconcile
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github-copilot-invite/internal/github"
+	"github-copilot-invite/internal/license"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Drift compares an organization's license row with the seats GitHub bills
+// for. ExpectedAvailable and Drift are null when the purchased count is not
+// known.
+type Drift struct {
+	Organization      string `json:"organization"`
+	SeatsInUse        int    `json:"seats_in_use"`
+	Purchased         int    `json:"licenses_purchased"`
+	Available         int    `json:"licenses_available"`
+	Reserved          int    `json:"licenses_reserved"`
+	ExpectedAvailable *int   `json:"expected_available"`
+	Drift             *int   `json:"drift"`
+	Corrected         bool   `json:"corrected"`
+	Deferred          bool   `json:"deferred,omitempty"`    // not corrected while licenses are reserved
+	MissingRow        bool   `json:"missing_row,omitempty"` // seats in use but no row in the ledger
+	Unsettled         bool   `json:"unsettled,omitempty"`   // an update of the row had an unknown outcome
+	Error             string `json:"error,omitempty"`
+}
+
+// Report is the result of a reconciliation run
+type Report struct {
+	GeneratedAt   time.Time `json:"generated_at"`
+	Applied       bool      `json:"applied"`
+	Organizations []Drift   `json:"organizations"`
+}
+
+// Reconciler compares the license ledger with the Copilot seats actually
+// assigned on GitHub
+type Reconciler struct {
+	githubClient *github.Client
+	licenses     license.Store
+}
+
+// New creates a new reconciler
+func New(githubClient *github.Client, licenses license.Store) *Reconciler {
+	return &Reconciler{
+		githubClient: githubClient,
+		licenses:     licenses,
+	}
+}
+
+// Run computes the drift of every organization in the ledger. With apply set,
+// the available count is corrected to purchased minus seats in use.
+// Organizations without a purchased figure are only reported, and so are
+// organizations with licenses reserved by invites in flight: their seats may
+// already be billed while the license is not committed yet. An unsettled
+// organization is settled once its row is found or made correct.
+// Organizations that hold seats but have no row are reported as well.
+func (r *Reconciler) Run(apply bool) (*Report, error) {
+	started := time.Now()
+	unsettled := make(map[string]bool)
+	for _, org := range r.licenses.Unsettled() {
+		unsettled[org] = true
+	}
+
+	licenses, err := r.licenses.List()
+	if err != nil {
+		return nil, fmt.Errorf("error reading license ledger: %v", err)
+	}
+
+	report := &Report{
+		GeneratedAt:   time.Now().UTC(),
+		Applied:       apply,
+		Organizations: make([]Drift, 0, len(licenses)),
+	}
+
+	known := make(map[string]bool, len(licenses))
+	for _, license := range licenses {
+		known[strings.ToLower(license.Organization)] = true
+		drift := Drift{
+			Organization: license.Organization,
+			Purchased:    license.Purchased,
+			Available:    license.Available,
+			Unsettled:    unsettled[license.Organization],
+		}
+
+		billing, err := r.githubClient.GetCopilotBilling(license.Organization)
+		if err != nil {
+			drift.Error = err.Error()
+			report.Organizations = append(report.Organizations, drift)
+			continue
+		}
+		drift.SeatsInUse = billing.SeatBreakdown.Total
+		drift.Reserved = r.reserved(license.Organization)
+
+		if license.Purchased > 0 {
+			expected := license.Purchased - drift.SeatsInUse
+			if expected < 0 {
+				expected = 0
+			}
+			difference := drift.Available - expected
+			drift.ExpectedAvailable = &expected
+			drift.Drift = &difference
+		}
+
+		if apply && drift.Drift != nil && *drift.Drift != 0 {
+			if drift.Reserved > 0 {
+				drift.Deferred = true
+			} else if err := r.licenses.SetAvailable(license.Organization, *drift.ExpectedAvailable); err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Corrected = true
+				log.Info().
+					Str("org", license.Organization).
+					Int("from", drift.Available).
+					Int("to", *drift.ExpectedAvailable).
+					Msg("Corrected available licenses")
+			}
+		}
+
+		if drift.Unsettled && drift.Drift != nil && (*drift.Drift == 0 || drift.Corrected) {
+			r.licenses.Settle(license.Organization, started)
+			drift.Unsettled = false
+		}
+
+		report.Organizations = append(report.Organizations, drift)
+	}
+
+	missing, err := r.missingRows(known)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to look for organizations without a license row")
+	}
+	report.Organizations = append(report.Organizations, missing...)
+
+	return report, nil
+}
+
+// reserved returns the licenses of an organization held by reservations
+func (r *Reconciler) reserved(org string) int {
+	reserved := 0
+	for _, reservation := range r.licenses.Reservations() {
+		if reservation.Organization == org {
+			reserved += reservation.Count
+		}
+	}
+	return reserved
+}
+
+// missingRows reports the organizations the client can see that hold Copilot
+// seats but are not in the ledger. Organizations whose billing cannot be read,
+// e.g. because they have no Copilot subscription, are skipped.
+func (r *Reconciler) missingRows(known map[string]bool) ([]Drift, error) {
+	orgs, err := r.githubClient.ListOrganizations()
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []Drift
+	for _, org := range orgs {
+		login := org.GetLogin()
+		if known[strings.ToLower(login)] {
+			continue
+		}
+		billing, err := r.githubClient.GetCopilotBilling(login)
+		if err != nil {
+			log.Debug().Err(err).Str("org", login).Msg("No Copilot billing for organization without a license row")
+			continue
+		}
+		if billing.SeatBreakdown.Total > 0 {
+			missing = append(missing, Drift{
+				Organization: login,
+				SeatsInUse:   billing.SeatBreakdown.Total,
+				MissingRow:   true,
+			})
+		}
+	}
+	return missing, nil
+}
+
+// Schedule runs the reconciler every interval until the returned stop
+// function is called
+func (r *Reconciler) Schedule(interval time.Duration, apply bool) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				report, err := r.Run(apply)
+				if err != nil {
+					log.Error().Err(err).Msg("Scheduled reconciliation failed")
+					continue
+				}
+				for _, drift := range report.Organizations {
+					if drift.Drift != nil && *drift.Drift != 0 || drift.MissingRow || drift.Error != "" || drift.Unsettled {
+						log.Warn().
+							Str("org", drift.Organization).
+							Interface("drift", drift.Drift).
+							Bool("missing_row", drift.MissingRow).
+							Bool("corrected", drift.Corrected).
+							Bool("unsettled", drift.Unsettled).
+							Str("error", drift.Error).
+							Msg("License drift detected")
+					}
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	log.Info().
+		Dur("interval", interval).
+		Bool("apply", apply).
+		Msg("Scheduled license reconciliation")
+
+	return func() { close(done) }
+}
@@ -0,0 +1,236 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github-copilot-invite/internal/github"
+	"github-copilot-invite/internal/license"
+	"github-copilot-invite/internal/smartsheet"
+)
+
+const (
+	testSheetID       = 42
+	orgColumnID       = 1
+	availableColumnID = 2
+	purchasedColumnID = 3
+)
+
+// fakeSheet is a local stand-in for the Smartsheet API serving a license
+// sheet with one row per organization
+type fakeSheet struct {
+	mu   sync.Mutex
+	rows []smartsheet.Row
+}
+
+// addRow adds an organization's row; a purchased count of 0 leaves the cell
+// empty
+func (f *fakeSheet) addRow(org string, available, purchased int) {
+	cells := []smartsheet.Cell{
+		{ColumnID: orgColumnID, Value: org},
+		{ColumnID: availableColumnID, Value: float64(available)},
+	}
+	if purchased > 0 {
+		cells = append(cells, smartsheet.Cell{ColumnID: purchasedColumnID, Value: float64(purchased)})
+	}
+	f.rows = append(f.rows, smartsheet.Row{ID: int64(100 + len(f.rows)), Version: 1, Cells: cells})
+}
+
+func (f *fakeSheet) available(org string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, row := range f.rows {
+		if row.Cells[0].Value == org {
+			return int(row.Cells[1].Value.(float64))
+		}
+	}
+	return -1
+}
+
+func (f *fakeSheet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sheet := "/sheets/" + strconv.Itoa(testSheetID)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == sheet:
+		json.NewEncoder(w).Encode(smartsheet.Sheet{
+			Columns: []smartsheet.Column{
+				{ID: orgColumnID, Title: "Organization"},
+				{ID: availableColumnID, Title: "Available"},
+				{ID: purchasedColumnID, Title: "Purchased"},
+			},
+			Rows: f.rows,
+		})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, sheet+"/rows/"):
+		id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, sheet+"/rows/"), 10, 64)
+		for _, row := range f.rows {
+			if row.ID == id {
+				json.NewEncoder(w).Encode(row)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPut && r.URL.Path == sheet+"/rows":
+		var updates []smartsheet.Row
+		json.NewDecoder(r.Body).Decode(&updates)
+		var result []smartsheet.Row
+		for _, update := range updates {
+			for i := range f.rows {
+				if f.rows[i].ID != update.ID {
+					continue
+				}
+				f.rows[i].Cells[1].Value = update.Cells[0].Value
+				f.rows[i].Version++
+				result = append(result, f.rows[i])
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "SUCCESS", "result": result})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// fakeGitHub serves the Copilot seats in use per organization and the
+// organizations the client belongs to
+func fakeGitHub(seats map[string]int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		var orgs []map[string]string
+		for org := range seats {
+			orgs = append(orgs, map[string]string{"login": org})
+		}
+		json.NewEncoder(w).Encode(orgs)
+	})
+	mux.HandleFunc("GET /orgs/{org}/copilot/billing", func(w http.ResponseWriter, r *http.Request) {
+		total, exists := seats[r.PathValue("org")]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"seat_breakdown": map[string]int{"total": total}})
+	})
+	return mux
+}
+
+// newTestReconciler returns a reconciler over a fake sheet and GitHub, and
+// the ledger it reads
+func newTestReconciler(t *testing.T, sheet *fakeSheet, seats map[string]int) (*Reconciler, *license.Ledger) {
+	t.Helper()
+	sheetServer := httptest.NewServer(sheet)
+	t.Cleanup(sheetServer.Close)
+	githubServer := httptest.NewServer(fakeGitHub(seats))
+	t.Cleanup(githubServer.Close)
+
+	columns := smartsheet.Columns{Organization: "Organization", Available: "Available", Purchased: "Purchased"}
+	validator := smartsheet.NewLicenseValidatorWithBaseURL("test-token", testSheetID, columns, sheetServer.URL)
+	client, err := github.NewClientWithBaseURL("test-token", githubServer.URL)
+	if err != nil {
+		t.Fatalf("NewClientWithBaseURL: %v", err)
+	}
+	ledger := license.NewLedger(validator, time.Minute)
+	return New(client, ledger), ledger
+}
+
+// byOrg indexes a report's organizations by name
+func byOrg(report *Report) map[string]Drift {
+	drifts := make(map[string]Drift, len(report.Organizations))
+	for _, drift := range report.Organizations {
+		drifts[drift.Organization] = drift
+	}
+	return drifts
+}
+
+func TestRunReport(t *testing.T) {
+	sheet := &fakeSheet{}
+	sheet.addRow("acme", 5, 10)
+	sheet.addRow("globex", 2, 0)
+	r, _ := newTestReconciler(t, sheet, map[string]int{"acme": 7, "globex": 1, "initech": 4, "hooli": 0})
+
+	report, err := r.Run(false)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	drifts := byOrg(report)
+
+	acme := drifts["acme"]
+	if acme.ExpectedAvailable == nil || *acme.ExpectedAvailable != 3 || acme.Drift == nil || *acme.Drift != 2 {
+		t.Errorf("acme = %+v, want expected 3 and drift 2", acme)
+	}
+	if acme.Corrected || sheet.available("acme") != 5 {
+		t.Error("a report-only run corrected the sheet")
+	}
+
+	if globex := drifts["globex"]; globex.Drift != nil || globex.ExpectedAvailable != nil {
+		t.Errorf("globex = %+v, want unknown drift without a purchased count", globex)
+	}
+
+	if initech := drifts["initech"]; !initech.MissingRow || initech.SeatsInUse != 4 {
+		t.Errorf("initech = %+v, want a missing row with 4 seats", initech)
+	}
+	if _, listed := drifts["hooli"]; listed {
+		t.Error("an organization without a row or seats was reported")
+	}
+}
+
+func TestRunApply(t *testing.T) {
+	sheet := &fakeSheet{}
+	sheet.addRow("acme", 5, 10)
+	sheet.addRow("globex", 2, 0)
+	r, _ := newTestReconciler(t, sheet, map[string]int{"acme": 7, "globex": 1})
+
+	report, err := r.Run(true)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	drifts := byOrg(report)
+	if !drifts["acme"].Corrected {
+		t.Errorf("acme = %+v, want corrected", drifts["acme"])
+	}
+	if got := sheet.available("acme"); got != 3 {
+		t.Errorf("acme available = %d, want 3", got)
+	}
+	if got := sheet.available("globex"); got != 2 {
+		t.Errorf("globex available = %d, want it left alone without a purchased count", got)
+	}
+}
+
+func TestRunDefersWhileReserved(t *testing.T) {
+	sheet := &fakeSheet{}
+	sheet.addRow("acme", 5, 10)
+	r, ledger := newTestReconciler(t, sheet, map[string]int{"acme": 7})
+
+	reservation, err := ledger.Reserve("acme", 1)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	report, err := r.Run(true)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	acme := byOrg(report)["acme"]
+	if !acme.Deferred || acme.Corrected || acme.Reserved != 1 {
+		t.Errorf("acme = %+v, want a deferred correction with 1 reserved", acme)
+	}
+	if got := sheet.available("acme"); got != 5 {
+		t.Errorf("acme available = %d, want 5 while a license is reserved", got)
+	}
+
+	if err := ledger.Release(reservation); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := r.Run(true); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := sheet.available("acme"); got != 3 {
+		t.Errorf("acme available = %d after the reservation was released, want 3", got)
+	}
+}
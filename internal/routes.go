@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"github-copilot-invite/internal/auth"
 	"github-copilot-invite/internal/handlers"
 	"github-copilot-invite/internal/middleware"
 
@@ -8,7 +9,7 @@ import (
 )
 
 // SetupRoutes configures all the routes for the application
-func SetupRoutes(r *gin.Engine, h *handlers.Handler) {
+func SetupRoutes(r *gin.Engine, h *handlers.Handler, credentials *auth.Credentials, verifier *auth.Verifier) {
 	// Health check endpoint (unprotected)
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -16,16 +17,54 @@ func SetupRoutes(r *gin.Engine, h *handlers.Handler) {
 		})
 	})
 
-	// API routes (protected with bearer token)
+	// API routes (protected with bearer token or JWT, each route needs a scope)
 	api := r.Group("/api/v1")
-	api.Use(middleware.BearerAuth())
+	api.Use(middleware.BearerAuth(credentials, verifier))
+	idempotent := middleware.Idempotency()
+	orgsRead := middleware.RequireScope(auth.ScopeOrgsRead)
+	teamsWrite := middleware.RequireScope(auth.ScopeTeamsWrite)
+	copilotInvite := middleware.RequireScope(auth.ScopeCopilotInvite)
+	copilotRevoke := middleware.RequireScope(auth.ScopeCopilotRevoke)
+	licensesAdmin := middleware.RequireScope(auth.ScopeLicensesAdmin)
 	{
 		// GitHub Organization endpoints
-		api.GET("/orgs", h.ListOrganizations)
-		api.GET("/orgs/:org/teams", h.ListTeams)
-		api.POST("/orgs/:org/teams", h.CreateTeam)
-		
+		api.GET("/orgs", orgsRead, h.ListOrganizations)
+		api.GET("/orgs/:org/teams", orgsRead, h.ListTeams)
+		api.POST("/orgs/:org/teams", teamsWrite, idempotent, h.CreateTeam)
+		api.GET("/orgs/:org/teams/:team_slug", orgsRead, h.GetTeam)
+		api.PATCH("/orgs/:org/teams/:team_slug", teamsWrite, h.UpdateTeam)
+		api.DELETE("/orgs/:org/teams/:team_slug", teamsWrite, h.DeleteTeam)
+		api.GET("/orgs/:org/teams/:team_slug/members", orgsRead, h.ListTeamMembers)
+		api.PUT("/orgs/:org/teams/:team_slug/members/:username", teamsWrite, h.AddTeamMember)
+		api.DELETE("/orgs/:org/teams/:team_slug/members/:username", teamsWrite, h.RemoveTeamMember)
+		api.GET("/orgs/:org/teams/:team_slug/teams", orgsRead, h.ListChildTeams)
+		api.GET("/orgs/:org/copilot/seats", orgsRead, h.ListCopilotSeats)
+		api.GET("/orgs/:org/copilot/billing", orgsRead, h.GetCopilotBilling)
+
 		// GitHub Copilot invite endpoint
-		api.POST("/copilot/invite", h.SendCopilotInvite)
+		api.POST("/copilot/invite", copilotInvite, idempotent, h.SendCopilotInvite)
+		api.POST("/copilot/invite/bulk", copilotInvite, idempotent, h.SendBulkCopilotInvite)
+
+		// Asynchronous invite job endpoints
+		api.POST("/jobs/invites", copilotInvite, idempotent, h.CreateInviteJob)
+		api.GET("/jobs/:id", copilotInvite, h.GetJob)
+
+		// GitHub Copilot seat revocation endpoints
+		api.DELETE("/copilot/seats/:org/:username", copilotRevoke, h.RevokeCopilotSeat)
+		api.DELETE("/copilot/seats/:org/teams/:team", copilotRevoke, h.RevokeCopilotTeamSeats)
+
+		// License cache endpoints
+		api.POST("/licenses/refresh", licensesAdmin, h.RefreshLicenses)
+		api.GET("/licenses/reservations", licensesAdmin, h.ListReservations)
+
+		// License reconciliation endpoints
+		api.GET("/reconcile/report", licensesAdmin, h.ReconcileReport)
+
+		// Desired state endpoints; applying needs every scope it may use
+		api.POST("/plan", orgsRead, h.Plan)
+		api.POST("/apply", teamsWrite, copilotInvite, copilotRevoke, idempotent, h.Apply)
+
+		// Access policy endpoints
+		api.POST("/authz/reload", middleware.RequireScope(auth.ScopeAll), h.ReloadPolicy)
 	}
 }
@@ -3,8 +3,11 @@ package server
 import (
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github-copilot-invite/internal/config"
+	"github-copilot-invite/internal/smartsheet"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -16,30 +19,94 @@ type Config struct {
 	Environment string
 	SSL         SSLConfig
 	Tokens      TokenConfig
+	GitHubApp   GitHubAppConfig
+	Reconcile   ReconcileConfig
+	Columns     smartsheet.Columns
+	Cache       CacheConfig
+	License     LicenseConfig
+	Jobs        JobsConfig
+	Invite      InviteConfig
 }
 
 // SSLConfig holds SSL-specific configuration
 type SSLConfig struct {
-	Enabled  bool
-	CertFile string
-	KeyFile  string
+	Enabled      bool
+	CertFile     string
+	KeyFile      string
+	ClientAuth   string // none, optional or required
+	ClientCAFile string // CA bundle client certificates are verified against
+	CRLFile      string // Optional, revoked client certificates
+}
+
+// ReconcileConfig holds license reconciliation settings
+type ReconcileConfig struct {
+	Interval time.Duration // 0 disables scheduled runs
+	Apply    bool
+}
+
+// LicenseConfig selects the license ledger backend
+type LicenseConfig struct {
+	Backend        string // smartsheet, csv or sqlite
+	CSVPath        string
+	SQLitePath     string
+	ReservationTTL time.Duration
+}
+
+// JobsConfig holds asynchronous invite job settings
+type JobsConfig struct {
+	Dir         string
+	Concurrency int
+	Retention   time.Duration // How long completed jobs are kept, 0 keeps them forever
+}
+
+// InviteConfig holds the requirements a user must meet to get a seat and
+// how the seat is assigned
+type InviteConfig struct {
+	RequireSAML      bool
+	RequireTwoFactor bool
+	AssignViaTeam    bool
+}
+
+// CacheConfig holds license cache settings
+type CacheConfig struct {
+	TTL             time.Duration
+	RefreshInterval time.Duration // 0 disables the background refresh
 }
 
 // TokenConfig holds sensitive token configuration
 type TokenConfig struct {
-	GitHub     string
-	Smartsheet string
-	API        string
+	GitHub       string
+	GitHubAppKey string
+	Smartsheet   string
+}
+
+// GitHubAppConfig holds GitHub App settings; an app ID of 0 means the
+// personal access token is used
+type GitHubAppConfig struct {
+	ID            int64
+	Installations map[string]int64
+	DefaultOrg    string
 }
 
 // NewConfig creates a new server configuration from viper settings
 func NewConfig() *Config {
 	// Get configuration manager
-	configMgr, err := config.NewManager("config.yaml")
+	configMgr, err := config.NewManager(viper.ConfigFileUsed())
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create config manager")
 	}
 
+	viper.SetDefault("smartsheet.columns.organization", "Organization Name")
+	viper.SetDefault("smartsheet.columns.available", "Available Licenses")
+	viper.SetDefault("smartsheet.cache_ttl", "5m")
+	viper.SetDefault("license.backend", "smartsheet")
+	viper.SetDefault("license.csv.path", "licenses.csv")
+	viper.SetDefault("license.sqlite.path", "licenses.db")
+	viper.SetDefault("license.reservation_ttl", "2m")
+	viper.SetDefault("jobs.dir", "data/jobs")
+	viper.SetDefault("jobs.concurrency", 4)
+	viper.SetDefault("jobs.retention", "168h")
+
 	port := viper.GetString("server.port")
 	if port == "" {
 		port = "8080"
@@ -50,15 +117,57 @@ func NewConfig() *Config {
 		Port:        port,
 		Environment: viper.GetString("server.environment"),
 		SSL: SSLConfig{
-			Enabled:  viper.GetBool("server.ssl.enabled"),
-			CertFile: viper.GetString("server.ssl.cert_file"),
-			KeyFile:  viper.GetString("server.ssl.key_file"),
+			Enabled:      viper.GetBool("server.ssl.enabled"),
+			CertFile:     viper.GetString("server.ssl.cert_file"),
+			KeyFile:      viper.GetString("server.ssl.key_file"),
+			ClientAuth:   strings.ToLower(viper.GetString("server.ssl.client_auth")),
+			ClientCAFile: viper.GetString("server.ssl.client_ca_file"),
+			CRLFile:      viper.GetString("server.ssl.crl_file"),
 		},
 		Tokens: TokenConfig{
-			GitHub:     configMgr.GetDecrypted("github.token"),
-			Smartsheet: configMgr.GetDecrypted("smartsheet.token"),
-			API:        configMgr.GetDecrypted("api.token"),
+			GitHub:       configMgr.GetDecrypted("github.token"),
+			GitHubAppKey: configMgr.GetDecrypted("github.app.private_key"),
+			Smartsheet:   configMgr.GetDecrypted("smartsheet.token"),
+		},
+		GitHubApp: GitHubAppConfig{
+			ID:            viper.GetInt64("github.app.id"),
+			Installations: make(map[string]int64),
+			DefaultOrg:    viper.GetString("github.app.default_org"),
+		},
+		Columns: smartsheet.Columns{
+			Organization: viper.GetString("smartsheet.columns.organization"),
+			Available:    viper.GetString("smartsheet.columns.available"),
+			Purchased:    viper.GetString("smartsheet.columns.purchased"),
+			CostCenter:   viper.GetString("smartsheet.columns.cost_center"),
+		},
+		License: LicenseConfig{
+			Backend:        viper.GetString("license.backend"),
+			CSVPath:        viper.GetString("license.csv.path"),
+			SQLitePath:     viper.GetString("license.sqlite.path"),
+			ReservationTTL: viper.GetDuration("license.reservation_ttl"),
+		},
+		Jobs: JobsConfig{
+			Dir:         viper.GetString("jobs.dir"),
+			Concurrency: viper.GetInt("jobs.concurrency"),
+			Retention:   viper.GetDuration("jobs.retention"),
 		},
+		Invite: InviteConfig{
+			RequireSAML:      viper.GetBool("invite.require_saml"),
+			RequireTwoFactor: viper.GetBool("invite.require_2fa"),
+			AssignViaTeam:    viper.GetBool("invite.assign_via_team"),
+		},
+		Cache: CacheConfig{
+			TTL:             viper.GetDuration("smartsheet.cache_ttl"),
+			RefreshInterval: viper.GetDuration("smartsheet.refresh_interval"),
+		},
+		Reconcile: ReconcileConfig{
+			Interval: viper.GetDuration("reconcile.interval"),
+			Apply:    viper.GetBool("reconcile.apply"),
+		},
+	}
+
+	for org := range viper.GetStringMap("github.app.installations") {
+		config.GitHubApp.Installations[org] = viper.GetInt64("github.app.installations." + org)
 	}
 
 	log.Info().
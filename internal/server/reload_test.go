@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github-copilot-invite/internal/auth"
+	"github-copilot-invite/internal/encryption"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// countingReloader counts its reloads and fails them if err is set
+type countingReloader struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+}
+
+func (r *countingReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	return r.err
+}
+
+func (r *countingReloader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	failing := &countingReloader{err: errors.New("invalid configuration")}
+	policy := &countingReloader{}
+	stop := reloadOnHangup(failing, policy)
+	defer stop()
+
+	for i := 1; i <= 2; i++ {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("sending SIGHUP: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for policy.count() < i && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		// A failed reload does not keep the others from running
+		if failing.count() != i || policy.count() != i {
+			t.Fatalf("after %d SIGHUPs reloaded %d and %d times, want %d each", i, failing.count(), policy.count(), i)
+		}
+	}
+}
+
+// useConfig points viper at a config file with contents in a temporary
+// working directory, which also holds the encryption key, and captures the
+// log
+func useConfig(t *testing.T, contents string) (string, *bytes.Buffer) {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	logger := log.Logger
+	var logs bytes.Buffer
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() {
+		log.Logger = logger
+		viper.Reset()
+		os.Chdir(wd)
+	})
+
+	file := filepath.Join(dir, "config.yaml")
+	writeFile(t, file, []byte(contents))
+	viper.SetConfigFile(file)
+	return file, &logs
+}
+
+func TestLoadCredentials(t *testing.T) {
+	file, logs := useConfig(t, "")
+	mgr, err := encryption.NewManager()
+	if err != nil {
+		t.Fatalf("encryption.NewManager: %v", err)
+	}
+	encrypted, err := mgr.Encrypt("old-shared-token")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	writeFile(t, file, []byte(`api:
+  token: "`+encrypted+`"
+  clients:
+    - name: ci
+      token_hash: "`+auth.HashToken("ci-token")+`"
+      scopes: ["copilot:invite"]
+`))
+
+	credentials, err := auth.NewCredentials(loadCredentials)
+	if err != nil {
+		t.Fatalf("NewCredentials: %v", err)
+	}
+	for _, token := range []string{"ci-token", "old-shared-token"} {
+		if _, ok := credentials.Authenticate(token); !ok {
+			t.Errorf("%q does not authenticate", token)
+		}
+	}
+	if strings.Contains(logs.String(), "not encrypted") {
+		t.Error("an encrypted api.token was reported as not encrypted")
+	}
+
+	// A token rotated in plain text is used, with a warning, and the file
+	// is left as it is
+	rotated := []byte("api:\n  token: new-shared-token\n")
+	writeFile(t, file, rotated)
+	if err := credentials.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, ok := credentials.Authenticate("new-shared-token"); !ok {
+		t.Error("the rotated token does not authenticate")
+	}
+	if _, ok := credentials.Authenticate("old-shared-token"); ok {
+		t.Error("the old token still authenticates")
+	}
+	if !strings.Contains(logs.String(), `"level":"warn","message":"api.token is not encrypted`) {
+		t.Errorf("no warning for a plain text api.token, log: %s", logs)
+	}
+	if data, _ := os.ReadFile(file); !bytes.Equal(data, rotated) {
+		t.Error("the reload rewrote the config file")
+	}
+}
+
+func TestLoadCredentialsRejectsInvalidReload(t *testing.T) {
+	file, _ := useConfig(t, "api:\n  token: shared-token\n")
+	credentials, err := auth.NewCredentials(loadCredentials)
+	if err != nil {
+		t.Fatalf("NewCredentials: %v", err)
+	}
+
+	invalid := map[string]string{
+		"client without scopes":  "api:\n  token: other-token\n  clients:\n    - name: ci\n      token_hash: \"" + auth.HashToken("ci-token") + "\"\n",
+		"undecryptable token":    "api:\n  token: \"ENC[not-a-ciphertext]\"\n",
+		"unparsable config file": "api: [\n",
+	}
+	for name, contents := range invalid {
+		writeFile(t, file, []byte(contents))
+		if err := credentials.Reload(); err == nil {
+			t.Errorf("%s: expected the reload to be rejected", name)
+		}
+		if _, ok := credentials.Authenticate("shared-token"); !ok {
+			t.Errorf("%s: the current token was dropped", name)
+		}
+		if _, ok := credentials.Authenticate("other-token"); ok {
+			t.Errorf("%s: a token from the rejected configuration authenticates", name)
+		}
+	}
+}
@@ -1,10 +1,27 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github-copilot-invite/internal"
+	"github-copilot-invite/internal/auth"
+	"github-copilot-invite/internal/authz"
+	"github-copilot-invite/internal/config"
+	"github-copilot-invite/internal/desired"
+	"github-copilot-invite/internal/encryption"
+	"github-copilot-invite/internal/github"
 	"github-copilot-invite/internal/handlers"
+	"github-copilot-invite/internal/invite"
+	"github-copilot-invite/internal/jobs"
+	"github-copilot-invite/internal/license"
+	"github-copilot-invite/internal/reconcile"
+	"github-copilot-invite/internal/smartsheet"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -13,9 +30,14 @@ import (
 
 // Server represents the HTTP server
 type Server struct {
-	config  *Config
-	router  *gin.Engine
-	handler *handlers.Handler
+	config      *Config
+	router      *gin.Engine
+	handler     *handlers.Handler
+	licenses    *license.Ledger
+	jobs        *jobs.Manager
+	reconciler  *reconcile.Reconciler
+	authz       *authz.Authorizer
+	credentials *auth.Credentials
 }
 
 // New creates a new server instance
@@ -30,12 +52,22 @@ func New() *Server {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// Initialize clients
+	githubClient := newGitHubClient(config)
+	licenses := newLicenseStore(config)
+	loadLicenses(licenses)
+	reconciler := reconcile.New(githubClient, licenses)
+
 	// Initialize handler
-	handler := handlers.NewHandler(
-		viper.GetString("github.token"),
-		viper.GetString("smartsheet.token"),
-		viper.GetInt64("smartsheet.sheet_id"),
-	)
+	invites := newInviteService(config, githubClient, licenses)
+	jobManager, err := jobs.NewManager(invites, licenses, config.Jobs.Dir, config.Jobs.Concurrency)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create job manager")
+	}
+	jobManager.SetRetention(config.Jobs.Retention)
+	planner := desired.New(githubClient, licenses, invites)
+	authorizer := newAuthorizer()
+	handler := handlers.NewHandler(githubClient, licenses, invites, jobManager, reconciler, planner, authorizer)
 
 	log.Debug().Msg("Handler initialized")
 
@@ -43,23 +75,300 @@ func New() *Server {
 	router := gin.Default()
 
 	// Setup routes
-	internal.SetupRoutes(router, handler)
+	credentials := newCredentials()
+	internal.SetupRoutes(router, handler, credentials, newVerifier())
 
 	log.Debug().Msg("Routes configured")
 
 	return &Server{
-		config:  config,
-		router:  router,
-		handler: handler,
+		config:      config,
+		router:      router,
+		handler:     handler,
+		licenses:    licenses,
+		jobs:        jobManager,
+		reconciler:  reconciler,
+		authz:       authorizer,
+		credentials: credentials,
+	}
+}
+
+// NewReconciler creates a license reconciler from the configuration, for use
+// outside of the HTTP server
+func NewReconciler(config *Config) *reconcile.Reconciler {
+	return reconcile.New(newGitHubClient(config), newLicenseStore(config))
+}
+
+// NewPlanner creates a desired state planner from the configuration, for use
+// outside of the HTTP server
+func NewPlanner(config *Config) *desired.Planner {
+	githubClient := newGitHubClient(config)
+	licenses := newLicenseStore(config)
+	return desired.New(githubClient, licenses, newInviteService(config, githubClient, licenses))
+}
+
+// newInviteService creates the invite service with the configured policy
+func newInviteService(config *Config, githubClient *github.Client, licenses license.Store) *invite.Service {
+	invites := invite.NewService(githubClient, licenses)
+	invites.SetPolicy(invite.Policy{
+		RequireSAML:      config.Invite.RequireSAML,
+		RequireTwoFactor: config.Invite.RequireTwoFactor,
+	})
+	invites.SetAssignViaTeam(config.Invite.AssignViaTeam)
+	return invites
+}
+
+// newGitHubClient creates the GitHub client from the configuration,
+// authenticating as a GitHub App if one is configured
+func newGitHubClient(config *Config) *github.Client {
+	baseURL := viper.GetString("github.base_url")
+	if config.GitHubApp.ID != 0 {
+		client, err := github.NewAppClient(github.AppConfig{
+			AppID:         config.GitHubApp.ID,
+			PrivateKey:    config.Tokens.GitHubAppKey,
+			Installations: config.GitHubApp.Installations,
+			DefaultOrg:    config.GitHubApp.DefaultOrg,
+		}, baseURL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create GitHub App client")
+		}
+		log.Info().Int64("app_id", config.GitHubApp.ID).Msg("Authenticating to GitHub as an app")
+		return client
+	}
+
+	if baseURL == "" {
+		return github.NewClient(config.Tokens.GitHub)
+	}
+
+	client, err := github.NewClientWithBaseURL(config.Tokens.GitHub, baseURL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create GitHub client")
+	}
+	return client
+}
+
+// reloadMu serializes re-reading the configuration file. viper is not safe
+// for concurrent use, and reloads run both on SIGHUP and from the policy
+// reload endpoint.
+var reloadMu sync.Mutex
+
+// newCredentials loads the API clients and the shared api.token
+func newCredentials() *auth.Credentials {
+	credentials, err := auth.NewCredentials(loadCredentials)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid API client configuration")
 	}
+	return credentials
+}
+
+// loadCredentials reads api.clients and decrypts api.token from the
+// configuration file the application was started with. The file is only
+// read: a token written in plain text on rotation is used as is, with a
+// warning, and encrypted on the next start. A token that cannot be decrypted
+// fails the load rather than disabling the shared token.
+func loadCredentials() (*auth.Registry, string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, "", fmt.Errorf("error reading config file: %v", err)
+	}
+	configMgr, err := config.NewManager(viper.ConfigFileUsed())
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating config manager: %v", err)
+	}
+
+	var clients []auth.Client
+	if err := viper.UnmarshalKey("api.clients", &clients); err != nil {
+		return nil, "", fmt.Errorf("error reading api clients: %v", err)
+	}
+	registry, err := auth.NewRegistry(clients)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := viper.GetString("api.token")
+	if token != "" && !encryption.IsEncrypted(token) {
+		log.Warn().Msg("api.token is not encrypted, it will be encrypted in the config file on the next start")
+	}
+	shared := configMgr.GetDecrypted("api.token")
+	if token != "" && shared == "" {
+		return nil, "", errors.New("error decrypting api.token")
+	}
+	return registry, shared, nil
+}
+
+// newVerifier creates the JWT verifier from api.oidc, or returns nil if no
+// identity provider is configured
+func newVerifier() *auth.Verifier {
+	if !viper.IsSet("api.oidc.issuer") {
+		return nil
+	}
+	var config auth.OIDCConfig
+	if err := viper.UnmarshalKey("api.oidc", &config); err != nil {
+		log.Fatal().Err(err).Msg("Failed to read OIDC configuration")
+	}
+	verifier, err := auth.NewVerifier(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up OIDC authentication")
+	}
+
+	log.Info().Str("issuer", config.Issuer).Int("roles", len(config.Roles)).Msg("OIDC authentication enabled")
+	return verifier
+}
+
+// newAuthorizer creates the role-based access control from rbac.bindings, or
+// returns nil if no bindings are configured
+func newAuthorizer() *authz.Authorizer {
+	if !viper.IsSet("rbac.bindings") {
+		return nil
+	}
+	authorizer, err := authz.NewAuthorizer(loadPolicy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid access policy")
+	}
+
+	log.Info().Msg("Role-based access control enabled")
+	return authorizer
+}
+
+// loadPolicy reads the role bindings, re-reading the configuration file so a
+// reload picks up edits
+func loadPolicy() (*authz.Policy, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	var bindings []authz.Binding
+	if err := viper.UnmarshalKey("rbac.bindings", &bindings); err != nil {
+		return nil, fmt.Errorf("error reading role bindings: %v", err)
+	}
+	return authz.NewPolicy(bindings)
+}
+
+// reloader is configuration that can be reloaded while serving
+type reloader interface {
+	Reload() error
+}
+
+// reloadOnHangup reloads the API credentials and the access policy whenever
+// the process receives SIGHUP, until the returned stop function is called
+func reloadOnHangup(reloaders ...reloader) func() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-hangup:
+				for _, r := range reloaders {
+					if err := r.Reload(); err != nil {
+						log.Error().Err(err).Msg("Reload failed, keeping the current configuration")
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hangup)
+		close(done)
+	}
+}
+
+// newLicenseStore creates the license ledger for the configured backend
+func newLicenseStore(config *Config) *license.Ledger {
+	var backend license.Backend
+	switch config.License.Backend {
+	case "", "smartsheet":
+		backend = newLicenseValidator(config)
+	case "csv":
+		backend = license.NewCSVBackend(config.License.CSVPath)
+	case "sqlite":
+		sqlite, err := license.NewSQLiteBackend(config.License.SQLitePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open license database")
+		}
+		backend = sqlite
+	default:
+		log.Fatal().Str("backend", config.License.Backend).Msg("Unknown license backend")
+	}
+
+	log.Info().Str("backend", config.License.Backend).Msg("License backend configured")
+	return license.NewLedger(backend, config.License.ReservationTTL)
+}
+
+// newLicenseValidator creates the Smartsheet license validator from the configuration
+func newLicenseValidator(config *Config) *smartsheet.LicenseValidator {
+	sheetID := viper.GetInt64("smartsheet.sheet_id")
+
+	var validator *smartsheet.LicenseValidator
+	if baseURL := viper.GetString("smartsheet.base_url"); baseURL != "" {
+		validator = smartsheet.NewLicenseValidatorWithBaseURL(config.Tokens.Smartsheet, sheetID, config.Columns, baseURL)
+	} else {
+		validator = smartsheet.NewLicenseValidator(config.Tokens.Smartsheet, sheetID, config.Columns)
+	}
+	validator.SetCacheTTL(config.Cache.TTL)
+	return validator
+}
+
+// loadLicenses loads the license ledger at startup. A sheet that lacks a
+// configured column is fatal; other errors are retried on first use.
+func loadLicenses(licenses license.Store) {
+	err := licenses.Refresh()
+	if err == nil {
+		log.Info().Msg("License ledger loaded")
+		return
+	}
+
+	var columnErr *smartsheet.ColumnError
+	if errors.As(err, &columnErr) {
+		log.Fatal().Err(err).Msg("License sheet does not match configured columns")
+	}
+	log.Warn().Err(err).Msg("Failed to load license ledger, will retry on first use")
 }
 
 // Start starts the server
 func (s *Server) Start() error {
 	addr := fmt.Sprintf(":%s", s.config.Port)
 
-	// Validate SSL configuration
+	// Pick up invite jobs interrupted by the last shutdown
+	s.jobs.Resume()
+
+	// Keep the license cache fresh in the background
+	if s.config.Cache.RefreshInterval > 0 {
+		stop := s.licenses.StartRefresher(s.config.Cache.RefreshInterval)
+		defer stop()
+	}
+
+	// Schedule license reconciliation
+	if s.config.Reconcile.Interval > 0 {
+		stop := s.reconciler.Schedule(s.config.Reconcile.Interval, s.config.Reconcile.Apply)
+		defer stop()
+	}
+
+	// Reload rotated credentials and the access policy on SIGHUP
+	reloaders := []reloader{s.credentials}
+	if s.authz != nil {
+		reloaders = append(reloaders, s.authz)
+	}
+	stop := reloadOnHangup(reloaders...)
+	defer stop()
+
+	// Validate SSL configuration; without TLS client certificates cannot be
+	// verified, so a server configured for them does not fall back to HTTP
+	clientAuth := s.config.SSL.ClientAuth != "" && s.config.SSL.ClientAuth != "none"
+	if clientAuth && !s.config.SSL.Enabled {
+		return errors.New("client_auth needs ssl to be enabled")
+	}
 	if err := s.config.ValidateSSL(); err != nil {
+		if clientAuth {
+			return err
+		}
 		log.Warn().
 			Err(err).
 			Msg("SSL validation failed, falling back to HTTP")
@@ -68,10 +377,21 @@ func (s *Server) Start() error {
 
 	// Start server with appropriate protocol
 	if s.config.SSL.Enabled {
+		tlsConfig, err := newTLSConfig(s.config.SSL)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{
+			Addr:      addr,
+			Handler:   s.router,
+			TLSConfig: tlsConfig,
+		}
+
 		log.Info().
 			Str("address", addr).
+			Str("client_auth", s.config.SSL.ClientAuth).
 			Msg("Starting HTTPS server")
-		return s.router.RunTLS(addr, s.config.SSL.CertFile, s.config.SSL.KeyFile)
+		return server.ListenAndServeTLS(s.config.SSL.CertFile, s.config.SSL.KeyFile)
 	}
 
 	log.Info().
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// newTLSConfig creates the TLS configuration of the HTTPS server, verifying
+// client certificates against the client CA bundle and the CRL file if
+// client authentication is enabled
+func newTLSConfig(ssl SSLConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch ssl.ClientAuth {
+	case "", "none":
+		return tlsConfig, nil
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "required":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client_auth %q, must be none, optional or required", ssl.ClientAuth)
+	}
+
+	if ssl.ClientCAFile == "" {
+		return nil, errors.New("client_auth needs a client_ca_file")
+	}
+	cas, err := readCertificates(ssl.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	for _, ca := range cas {
+		tlsConfig.ClientCAs.AddCert(ca)
+	}
+
+	if ssl.CRLFile != "" {
+		crls := &crlChecker{file: ssl.CRLFile, cas: cas}
+		if err := crls.load(); err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = crls.verify
+	}
+	return tlsConfig, nil
+}
+
+// readCertificates reads the certificates of a PEM bundle
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file: %v", err)
+	}
+
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing client CA file: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("error parsing client CA file: no certificates in %s", file)
+	}
+	return certs, nil
+}
+
+// crlChecker rejects client certificates revoked by a CRL issued by one of
+// the client CAs. The CRL file is reloaded when it changes.
+type crlChecker struct {
+	file string
+	cas  []*x509.Certificate
+
+	mu      sync.Mutex
+	modTime time.Time
+	revoked map[string]bool // raw issuer and serial number
+}
+
+// verify is the tls.Config VerifyPeerCertificate hook, called after the
+// chain has been verified
+func (r *crlChecker) verify(_ [][]byte, chains [][]*x509.Certificate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if info, err := os.Stat(r.file); err == nil && !info.ModTime().Equal(r.modTime) {
+		if err := r.loadLocked(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload CRL, using the previous one")
+		}
+	}
+
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if r.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())] {
+				return fmt.Errorf("client certificate %s (serial %s) is revoked", cert.Subject, cert.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
+
+// load reads the CRL file
+func (r *crlChecker) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+// loadLocked reads the CRLs of the file, in PEM or DER form, and checks that
+// each is signed by a client CA. The caller must hold mu.
+func (r *crlChecker) loadLocked() error {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return fmt.Errorf("error reading CRL file: %v", err)
+	}
+	data, err := os.ReadFile(r.file)
+	if err != nil {
+		return fmt.Errorf("error reading CRL file: %v", err)
+	}
+
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	revoked := make(map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("error parsing CRL file: %v", err)
+		}
+		if err := r.checkIssuer(crl); err != nil {
+			return err
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			log.Warn().Str("issuer", crl.Issuer.String()).Time("next_update", crl.NextUpdate).Msg("CRL is past its next update")
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, entry.SerialNumber.String())] = true
+		}
+	}
+
+	r.revoked = revoked
+	r.modTime = info.ModTime()
+	log.Info().Str("file", r.file).Int("revoked", len(revoked)).Msg("CRL loaded")
+	return nil
+}
+
+// checkIssuer checks that a CRL is signed by one of the client CAs
+func (r *crlChecker) checkIssuer(crl *x509.RevocationList) error {
+	for _, ca := range r.cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("error checking CRL file: CRL of %s is not signed by a client CA", crl.Issuer)
+}
+
+func revocationKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing client certificates and CRLs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing CA certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writeCert writes the CA certificate as PEM and returns the file
+func (ca *testCA) writeCert(t *testing.T) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatalf("writing CA file: %v", err)
+	}
+	return file
+}
+
+// issue returns a client certificate with a serial number
+func (ca *testCA) issue(t *testing.T, serial int64) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating client key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCRL writes a PEM CRL revoking serials, due for update at nextUpdate,
+// to file
+func (ca *testCA) writeCRL(t *testing.T, file string, number int64, nextUpdate time.Time, serials ...int64) {
+	t.Helper()
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(number),
+		ThisUpdate:                time.Now().Add(-2 * time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("creating CRL: %v", err)
+	}
+	writeFile(t, file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+}
+
+// writeFile replaces a file and moves its modification time forward, so a
+// change is seen even within the file system's timestamp resolution
+func writeFile(t *testing.T, file string, data []byte) {
+	t.Helper()
+	var modTime time.Time
+	if info, err := os.Stat(file); err == nil {
+		modTime = info.ModTime()
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("writing %s: %v", file, err)
+	}
+	if !modTime.IsZero() {
+		later := modTime.Add(time.Second)
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatalf("touching %s: %v", file, err)
+		}
+	}
+}
+
+// newTLSServer starts an HTTPS server with the client verification of ssl
+func newTLSServer(t *testing.T, ssl SSLConfig) *httptest.Server {
+	t.Helper()
+	tlsConfig, err := newTLSConfig(ssl)
+	if err != nil {
+		t.Fatalf("newTLSConfig: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = tlsConfig
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get makes a request presenting the client certificate, if any, and reports
+// whether it was served
+func get(t *testing.T, server *httptest.Server, certs ...tls.Certificate) bool {
+	t.Helper()
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	// Present the certificate even when the server does not list its CA,
+	// which the client would otherwise leave out
+	transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if len(certs) == 0 {
+			return &tls.Certificate{}, nil
+		}
+		return &certs[0], nil
+	}
+	client.Transport = transport
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent
+}
+
+func TestClientCertificateVerification(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	other := newTestCA(t, "other CA")
+
+	required := newTLSServer(t, SSLConfig{ClientAuth: "required", ClientCAFile: ca.writeCert(t)})
+	if !get(t, required, ca.issue(t, 10)) {
+		t.Error("a certificate from the client CA was refused")
+	}
+	if get(t, required) {
+		t.Error("a request without a certificate was served")
+	}
+	if get(t, required, other.issue(t, 10)) {
+		t.Error("a certificate from another CA was accepted")
+	}
+
+	optional := newTLSServer(t, SSLConfig{ClientAuth: "optional", ClientCAFile: ca.writeCert(t)})
+	if !get(t, optional) {
+		t.Error("a request without a certificate was refused with optional client auth")
+	}
+	if get(t, optional, other.issue(t, 10)) {
+		t.Error("a certificate from another CA was accepted with optional client auth")
+	}
+}
+
+func TestRevokedClientCertificate(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	crlFile := filepath.Join(t.TempDir(), "clients.crl")
+	ca.writeCRL(t, crlFile, 1, time.Now().Add(time.Hour), 11)
+
+	server := newTLSServer(t, SSLConfig{ClientAuth: "required", ClientCAFile: ca.writeCert(t), CRLFile: crlFile})
+	if get(t, server, ca.issue(t, 11)) {
+		t.Error("a revoked certificate was accepted")
+	}
+	if !get(t, server, ca.issue(t, 12)) {
+		t.Error("a certificate that is not revoked was refused")
+	}
+
+	// An updated CRL is picked up without a restart
+	ca.writeCRL(t, crlFile, 2, time.Now().Add(time.Hour), 11, 12)
+	if get(t, server, ca.issue(t, 12)) {
+		t.Error("a certificate revoked by the updated CRL was accepted")
+	}
+}
+
+func TestStaleCRL(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	crlFile := filepath.Join(t.TempDir(), "clients.crl")
+
+	// A CRL past its next update is still enforced
+	ca.writeCRL(t, crlFile, 1, time.Now().Add(-time.Hour), 11)
+	server := newTLSServer(t, SSLConfig{ClientAuth: "required", ClientCAFile: ca.writeCert(t), CRLFile: crlFile})
+	if get(t, server, ca.issue(t, 11)) {
+		t.Error("a certificate revoked by a stale CRL was accepted")
+	}
+	if !get(t, server, ca.issue(t, 12)) {
+		t.Error("a certificate that is not revoked was refused")
+	}
+}
+
+func TestUnreadableCRL(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	caFile := ca.writeCert(t)
+	crlFile := filepath.Join(t.TempDir(), "clients.crl")
+
+	// The server does not start without a usable CRL
+	if _, err := newTLSConfig(SSLConfig{ClientAuth: "required", ClientCAFile: caFile, CRLFile: crlFile}); err == nil {
+		t.Error("expected an error for a missing CRL file")
+	}
+	writeFile(t, crlFile, []byte("not a CRL"))
+	if _, err := newTLSConfig(SSLConfig{ClientAuth: "required", ClientCAFile: caFile, CRLFile: crlFile}); err == nil {
+		t.Error("expected an error for a corrupt CRL file")
+	}
+	newTestCA(t, "other CA").writeCRL(t, crlFile, 1, time.Now().Add(time.Hour))
+	if _, err := newTLSConfig(SSLConfig{ClientAuth: "required", ClientCAFile: caFile, CRLFile: crlFile}); err == nil {
+		t.Error("expected an error for a CRL not signed by a client CA")
+	}
+
+	// Once running, a CRL that becomes unreadable leaves the last one in force
+	ca.writeCRL(t, crlFile, 2, time.Now().Add(time.Hour), 11)
+	server := newTLSServer(t, SSLConfig{ClientAuth: "required", ClientCAFile: caFile, CRLFile: crlFile})
+	writeFile(t, crlFile, []byte("not a CRL"))
+	if get(t, server, ca.issue(t, 11)) {
+		t.Error("a revoked certificate was accepted after the CRL became unreadable")
+	}
+	if err := os.Remove(crlFile); err != nil {
+		t.Fatalf("removing CRL file: %v", err)
+	}
+	if get(t, server, ca.issue(t, 11)) {
+		t.Error("a revoked certificate was accepted after the CRL file was removed")
+	}
+	if !get(t, server, ca.issue(t, 12)) {
+		t.Error("a certificate that is not revoked was refused")
+	}
+}
+
+func TestNewTLSConfigRejects(t *testing.T) {
+	caFile := newTestCA(t, "client CA").writeCert(t)
+	tests := []struct {
+		name string
+		ssl  SSLConfig
+	}{
+		{"invalid client_auth", SSLConfig{ClientAuth: "sometimes", ClientCAFile: caFile}},
+		{"no client CA", SSLConfig{ClientAuth: "required"}},
+		{"missing client CA file", SSLConfig{ClientAuth: "required", ClientCAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTLSConfig(tt.ssl); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	config, err := newTLSConfig(SSLConfig{ClientAuth: "none"})
+	if err != nil || config.ClientAuth != tls.NoClientCert {
+		t.Errorf("newTLSConfig(none) = %v, %v, want no client certificates", config, err)
+	}
+}
@@ -1,43 +1,148 @@
 package smartsheet
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github-copilot-invite/internal/license"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultBaseURL = "https://api.smartsheet.com/2.0"
+
+	// maxUpdateAttempts bounds the retries of a license update whose row
+	// keeps changing underneath it
+	maxUpdateAttempts = 3
 )
 
+// Columns names the sheet columns holding license data. Purchased and
+// CostCenter are optional and ignored when empty.
+type Columns struct {
+	Organization string
+	Available    string
+	Purchased    string
+	CostCenter   string
+}
+
+// ColumnError reports a configured column that does not exist in the sheet
+type ColumnError struct {
+	Key   string
+	Title string
+}
+
+func (e *ColumnError) Error() string {
+	return fmt.Sprintf("column %q configured as smartsheet.columns.%s not found in sheet", e.Title, e.Key)
+}
+
 type LicenseValidator struct {
 	client    *http.Client
 	token     string
 	sheetID   int64
-	cacheLock sync.RWMutex
-	cache     map[string]int // org -> available licenses
+	baseURL   string
+	columns   Columns
+	cacheLock sync.RWMutex           // guards the cache only; sheet updates rely on row versions
+	cache     map[string]*licenseRow // org -> license row
+	loadedAt  time.Time
+	ttl       time.Duration // 0 keeps cached rows until an org is missing
+
+	refreshing atomic.Bool
+}
+
+// licenseRow is an organization's row in the license sheet
+type licenseRow struct {
+	license.License
+
+	rowID             int64
+	availableColumnID int64
+	version           int64
 }
 
 type Sheet struct {
-	Rows []Row `json:"rows"`
+	Columns []Column `json:"columns"`
+	Rows    []Row    `json:"rows"`
+}
+
+type Column struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
 }
 
 type Row struct {
-	Cells []Cell `json:"cells"`
+	ID      int64  `json:"id,omitempty"`
+	Version int64  `json:"version,omitempty"`
+	Cells   []Cell `json:"cells"`
 }
 
 type Cell struct {
-	Value interface{} `json:"value"`
+	ColumnID int64       `json:"columnId,omitempty"`
+	Value    interface{} `json:"value"`
 }
 
-func NewLicenseValidator(token string, sheetID int64) *LicenseValidator {
+func NewLicenseValidator(token string, sheetID int64, columns Columns) *LicenseValidator {
 	return &LicenseValidator{
 		client:  &http.Client{},
 		token:   token,
 		sheetID: sheetID,
-		cache:   make(map[string]int),
+		baseURL: defaultBaseURL,
+		columns: columns,
+		cache:   make(map[string]*licenseRow),
 	}
 }
 
-func (v *LicenseValidator) RefreshLicenseCache() error {
-	url := fmt.Sprintf("https://api.smartsheet.com/2.0/sheets/%d", v.sheetID)
+// NewLicenseValidatorWithBaseURL creates a validator that talks to the given
+// API base URL instead of api.smartsheet.com, e.g. a local fake server.
+func NewLicenseValidatorWithBaseURL(token string, sheetID int64, columns Columns, baseURL string) *LicenseValidator {
+	v := NewLicenseValidator(token, sheetID, columns)
+	v.baseURL = strings.TrimSuffix(baseURL, "/")
+	return v
+}
+
+// SetCacheTTL sets how long cached rows are trusted. Once the TTL has
+// passed, reads keep serving the cached values while the sheet is reloaded
+// in the background.
+func (v *LicenseValidator) SetCacheTTL(ttl time.Duration) {
+	v.cacheLock.Lock()
+	defer v.cacheLock.Unlock()
+
+	v.ttl = ttl
+}
+
+// revalidate reloads the sheet in the background unless a reload is
+// already running
+func (v *LicenseValidator) revalidate() {
+	if !v.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer v.refreshing.Store(false)
+		if err := v.Refresh(); err != nil {
+			log.Warn().Err(err).Msg("Failed to revalidate stale license cache")
+		}
+	}()
+}
+
+// stale reports whether the cached rows are older than the TTL
+func (v *LicenseValidator) stale() bool {
+	v.cacheLock.RLock()
+	defer v.cacheLock.RUnlock()
+
+	return v.ttl > 0 && time.Since(v.loadedAt) > v.ttl
+}
+
+// Refresh reloads the license sheet into the cache
+func (v *LicenseValidator) Refresh() error {
+	url := fmt.Sprintf("%s/sheets/%d", v.baseURL, v.sheetID)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("error creating request: %v", err)
@@ -59,66 +164,450 @@ func (v *LicenseValidator) RefreshLicenseCache() error {
 		return fmt.Errorf("error decoding response: %v", err)
 	}
 
+	ids, err := v.columnIDs(sheet.Columns)
+	if err != nil {
+		return err
+	}
+
 	v.cacheLock.Lock()
 	defer v.cacheLock.Unlock()
 
 	// Clear existing cache
-	v.cache = make(map[string]int)
+	v.cache = make(map[string]*licenseRow)
+	v.loadedAt = time.Now()
 
 	// Process rows and update cache
-	// Note: Column indices should be adjusted based on your actual sheet structure
 	for _, row := range sheet.Rows {
-		if len(row.Cells) < 2 {
-			continue
+		values := make(map[int64]interface{}, len(row.Cells))
+		for _, cell := range row.Cells {
+			values[cell.ColumnID] = cell.Value
 		}
-		
-		org, ok := row.Cells[0].Value.(string)
+
+		org, ok := values[ids.organization].(string)
 		if !ok {
 			continue
 		}
-		
-		licenses, ok := row.Cells[1].Value.(float64)
+
+		licenses, ok := values[ids.available].(float64)
 		if !ok {
 			continue
 		}
-		
-		v.cache[org] = int(licenses)
+
+		entry := &licenseRow{
+			License: license.License{
+				Organization: org,
+				Available:    int(licenses),
+			},
+			rowID:             row.ID,
+			availableColumnID: ids.available,
+			version:           row.Version,
+		}
+		if purchased, ok := values[ids.purchased].(float64); ok && ids.purchased != 0 {
+			entry.Purchased = int(purchased)
+		}
+		if costCenter, ok := values[ids.costCenter].(string); ok && ids.costCenter != 0 {
+			entry.CostCenter = costCenter
+		}
+
+		v.cache[org] = entry
 	}
 
 	return nil
 }
 
-func (v *LicenseValidator) CheckLicenseAvailability(org string) (bool, error) {
+// columnIDs holds the IDs of the configured columns; optional columns that
+// are not configured have ID 0
+type columnIDs struct {
+	organization int64
+	available    int64
+	purchased    int64
+	costCenter   int64
+}
+
+// columnIDs resolves the configured column titles against the sheet's columns
+func (v *LicenseValidator) columnIDs(columns []Column) (*columnIDs, error) {
+	byTitle := make(map[string]int64, len(columns))
+	for _, column := range columns {
+		byTitle[column.Title] = column.ID
+	}
+
+	lookup := func(key, title string, required bool) (int64, error) {
+		if title == "" && !required {
+			return 0, nil
+		}
+		id, ok := byTitle[title]
+		if !ok {
+			return 0, &ColumnError{Key: key, Title: title}
+		}
+		return id, nil
+	}
+
+	var ids columnIDs
+	var err error
+	if ids.organization, err = lookup("organization", v.columns.Organization, true); err != nil {
+		return nil, err
+	}
+	if ids.available, err = lookup("available", v.columns.Available, true); err != nil {
+		return nil, err
+	}
+	if ids.purchased, err = lookup("purchased", v.columns.Purchased, false); err != nil {
+		return nil, err
+	}
+	if ids.costCenter, err = lookup("cost_center", v.columns.CostCenter, false); err != nil {
+		return nil, err
+	}
+	return &ids, nil
+}
+
+// Available returns the number of licenses left for an organization
+// according to the sheet. Unknown organizations have no licenses.
+func (v *LicenseValidator) Available(org string) (int, error) {
 	v.cacheLock.RLock()
-	licenses, exists := v.cache[org]
+	entry, exists := v.cache[org]
 	v.cacheLock.RUnlock()
 
 	if !exists {
-		if err := v.RefreshLicenseCache(); err != nil {
-			return false, err
+		if err := v.Refresh(); err != nil {
+			return 0, err
 		}
 		v.cacheLock.RLock()
-		licenses = v.cache[org]
+		entry, exists = v.cache[org]
 		v.cacheLock.RUnlock()
 	}
 
-	return licenses > 0, nil
+	if !exists {
+		return 0, nil
+	}
+
+	// Serve the cached value and reload behind it
+	if v.stale() {
+		v.revalidate()
+	}
+	return entry.Available, nil
+}
+
+// List returns a snapshot of every organization's row in the sheet
+func (v *LicenseValidator) List() ([]license.License, error) {
+	if err := v.Refresh(); err != nil {
+		return nil, err
+	}
+
+	v.cacheLock.RLock()
+	defer v.cacheLock.RUnlock()
+
+	licenses := make([]license.License, 0, len(v.cache))
+	for _, row := range v.cache {
+		licenses = append(licenses, row.License)
+	}
+	sort.Slice(licenses, func(i, j int) bool {
+		return licenses[i].Organization < licenses[j].Organization
+	})
+	return licenses, nil
+}
+
+// Adjust adds delta to an organization's available licenses. Concurrent
+// updates are detected by row version, see updateLicense.
+func (v *LicenseValidator) Adjust(org string, delta int) error {
+	return v.updateLicense(org, func(available int) (int, error) {
+		if available+delta < 0 {
+			return 0, license.ErrNoLicenses
+		}
+		return available + delta, nil
+	})
+}
+
+// SetAvailable overwrites the available license count of an organization in
+// the sheet.
+func (v *LicenseValidator) SetAvailable(org string, available int) error {
+	return v.updateLicense(org, func(int) (int, error) {
+		return available, nil
+	})
 }
 
-func (v *LicenseValidator) DecrementLicense(org string) error {
+// updateLicense applies change to an organization's available license count
+// and writes the result back to the sheet.
+//
+// The row is re-read before writing and compared with the version the caller
+// last saw. If another writer (another replica, or a concurrent request in
+// this one) changed the row in the meantime, the fresh values are taken and
+// the update is retried. Running out of licenses because of such a conflict
+// is reported as ErrLicenseTaken.
+//
+// Smartsheet has no conditional writes, so a write landing between that read
+// and ours cannot be prevented. It is detected from the row version after our
+// write, the value we overwrote is restored from the cell history and the
+// update is retried on top of it. ErrLicenseTaken is only returned when our
+// value is known not to be in the sheet. If the row version cannot be read
+// back or the overwritten value cannot be restored, our value may or may not
+// be in the sheet; that is reported as ErrOutcomeUnknown and left to the
+// reconciler.
+func (v *LicenseValidator) updateLicense(org string, change func(available int) (int, error)) error {
+	expected, err := v.cachedLicense(org)
+	if err != nil {
+		return err
+	}
+
+	conflicted := false
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		current, err := v.fetchLicense(expected)
+		if err != nil {
+			return fmt.Errorf("error reading licenses for org %s: %v", org, err)
+		}
+
+		if current.version != expected.version {
+			log.Debug().
+				Str("org", org).
+				Int64("expected_version", expected.version).
+				Int64("version", current.version).
+				Msg("License row changed since last read, retrying")
+			conflicted = true
+			expected = current
+			v.storeLicense(current)
+			continue
+		}
+
+		available, err := change(current.Available)
+		if err != nil {
+			if conflicted && errors.Is(err, license.ErrNoLicenses) {
+				return license.ErrLicenseTaken
+			}
+			return err
+		}
+
+		// Update Smartsheet first so a rejected write leaves the cache untouched
+		version, err := v.updateAvailable(current, available)
+		if err != nil {
+			return fmt.Errorf("error updating licenses for org %s: %v", org, err)
+		}
+		if version == 0 {
+			written, err := v.fetchLicense(current)
+			if err != nil {
+				return fmt.Errorf("%w: licenses of org %s written but the row could not be read back: %v", license.ErrOutcomeUnknown, org, err)
+			}
+			version = written.version
+		}
+		if version != current.version+1 {
+			log.Warn().
+				Str("org", org).
+				Int64("expected_version", current.version+1).
+				Int64("version", version).
+				Msg("Concurrent license update overwritten, restoring it")
+			restored, err := v.restoreOverwritten(current, available, version)
+			if err != nil {
+				return fmt.Errorf("%w: failed to restore overwritten license update of org %s: %v", license.ErrOutcomeUnknown, org, err)
+			}
+			conflicted = true
+			expected = restored
+			v.storeLicense(restored)
+			continue
+		}
+
+		// Update local cache
+		current.Available = available
+		current.version = version
+		v.storeLicense(current)
+		return nil
+	}
+
+	// Every attempt either wrote nothing or had its write undone by a restore
+	return license.ErrLicenseTaken
+}
+
+// restoreOverwritten writes back the value a conflicting write had stored
+// before our write of written replaced it. The row must still be at version,
+// the one our write produced, so that the newest cell history entry is ours
+// and the one before it the overwritten value. A third write landing just
+// before the restore cannot be prevented; it shows up as a skipped version
+// afterwards and is reported as an error, since the restore may then have
+// clobbered it.
+func (v *LicenseValidator) restoreOverwritten(entry *licenseRow, written int, version int64) (*licenseRow, error) {
+	current, err := v.fetchLicense(entry)
+	if err != nil {
+		return nil, err
+	}
+	if current.version != version {
+		return nil, fmt.Errorf("row changed again after the conflicting write, version %d instead of %d", current.version, version)
+	}
+
+	history, err := v.fetchHistory(entry, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) < 2 || history[0] != written {
+		return nil, fmt.Errorf("cell history does not start with our write of %d", written)
+	}
+	overwritten := history[1]
+
+	restoredVersion, err := v.updateAvailable(current, overwritten)
+	if err != nil {
+		return nil, err
+	}
+	if restoredVersion == 0 {
+		restored, err := v.fetchLicense(current)
+		if err != nil {
+			return nil, fmt.Errorf("restored %d but the row could not be read back: %v", overwritten, err)
+		}
+		restoredVersion = restored.version
+	}
+	if restoredVersion != version+1 {
+		return nil, fmt.Errorf("row changed while restoring %d, version %d instead of %d", overwritten, restoredVersion, version+1)
+	}
+
+	current.Available = overwritten
+	current.version = version + 1
+	return current, nil
+}
+
+// cachedLicense returns a copy of an organization's cached license row,
+// loading the sheet if the organization is not cached yet
+func (v *LicenseValidator) cachedLicense(org string) (*licenseRow, error) {
+	v.cacheLock.RLock()
+	entry, exists := v.cache[org]
+	v.cacheLock.RUnlock()
+
+	if !exists {
+		if err := v.Refresh(); err != nil {
+			return nil, err
+		}
+		v.cacheLock.RLock()
+		entry, exists = v.cache[org]
+		v.cacheLock.RUnlock()
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("unknown org: %s", org)
+	}
+
+	copied := *entry
+	return &copied, nil
+}
+
+// storeLicense replaces an organization's cached license row
+func (v *LicenseValidator) storeLicense(entry *licenseRow) {
 	v.cacheLock.Lock()
 	defer v.cacheLock.Unlock()
 
-	if v.cache[org] <= 0 {
-		return fmt.Errorf("no licenses available for org: %s", org)
+	copied := *entry
+	v.cache[entry.Organization] = &copied
+}
+
+// fetchLicense reads the current state of a license row from the sheet
+func (v *LicenseValidator) fetchLicense(entry *licenseRow) (*licenseRow, error) {
+	url := fmt.Sprintf("%s/sheets/%d/rows/%d", v.baseURL, v.sheetID, entry.rowID)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
 
-	// Update local cache
-	v.cache[org]--
+	req.Header.Add("Authorization", "Bearer "+v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
 
-	// Update Smartsheet
-	// This would involve making a PUT request to update the specific cell
-	// Implementation depends on your sheet structure and business logic
-	// For now, we'll just return success
-	return nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var row Row
+	if err := json.NewDecoder(resp.Body).Decode(&row); err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+
+	current := *entry
+	current.version = row.Version
+	for _, cell := range row.Cells {
+		if cell.ColumnID != entry.availableColumnID {
+			continue
+		}
+		available, ok := cell.Value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("available licenses of org %s is not a number", entry.Organization)
+		}
+		current.Available = int(available)
+	}
+	return &current, nil
+}
+
+// fetchHistory returns up to count of the newest values of a license row's
+// available column, newest first
+func (v *LicenseValidator) fetchHistory(entry *licenseRow, count int) ([]int, error) {
+	url := fmt.Sprintf("%s/sheets/%d/rows/%d/columns/%d/history?pageSize=%d", v.baseURL, v.sheetID, entry.rowID, entry.availableColumnID, count)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Add("Authorization", "Bearer "+v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Data []Cell `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding response: %v", err)
+	}
+
+	values := make([]int, 0, len(result.Data))
+	for _, cell := range result.Data {
+		value, ok := cell.Value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("available licenses of org %s is not a number in the cell history", entry.Organization)
+		}
+		values = append(values, int(value))
+	}
+	return values, nil
+}
+
+// updateAvailable writes the available license count to the license's row
+// and returns the row version after the write
+func (v *LicenseValidator) updateAvailable(entry *licenseRow, available int) (int64, error) {
+	rows := []Row{{
+		ID: entry.rowID,
+		Cells: []Cell{{
+			ColumnID: entry.availableColumnID,
+			Value:    available,
+		}},
+	}}
+	body, err := json.Marshal(rows)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding rows: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/sheets/%d/rows", v.baseURL, v.sheetID)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Add("Authorization", "Bearer "+v.token)
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Result []Row `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || len(result.Result) == 0 {
+		// The write succeeded; the version is only used for conflict detection
+		return 0, nil
+	}
+
+	return result.Result[0].Version, nil
 }
@@ -0,0 +1,656 @@
+package smartsheet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github-copilot-invite/internal/license"
+)
+
+const (
+	testSheetID = 42
+
+	orgColumnID       = 1
+	availableColumnID = 2
+	purchasedColumnID = 3
+)
+
+var testColumns = Columns{Organization: "Organization", Available: "Available", Purchased: "Purchased"}
+
+// fakeSheet is a local stand-in for the Smartsheet API serving one license
+// sheet. Every write bumps the row version and is recorded in the cell
+// history, as Smartsheet does; like Smartsheet, writes are unconditional.
+type fakeSheet struct {
+	t *testing.T
+
+	mu           sync.Mutex
+	rows         []*Row
+	history      map[int64][]interface{} // row ID -> available values, newest first
+	rejectWrites bool
+	omitResult   bool // answer writes without the updated rows
+	failRowReads bool
+	writes       int
+
+	// beforeWrite and afterWrite, if set, run around each write with mu
+	// held, so that a test can land another writer's update right next to
+	// it. n counts the writes, starting at 1.
+	beforeWrite func(n int)
+	afterWrite  func(n int)
+
+	// rowReads, if set, holds row reads until that many have arrived, so
+	// that concurrent updates all read before any of them writes
+	rowReads *barrier
+}
+
+func newFakeSheet(t *testing.T) *fakeSheet {
+	return &fakeSheet{t: t, history: make(map[int64][]interface{})}
+}
+
+// barrier releases its waiters once n of them have arrived, and lets every
+// later caller through
+type barrier struct {
+	mu      sync.Mutex
+	waiting int
+	release chan struct{}
+}
+
+func newBarrier(n int) *barrier {
+	return &barrier{waiting: n, release: make(chan struct{})}
+}
+
+func (b *barrier) wait() {
+	b.mu.Lock()
+	if b.waiting > 0 {
+		b.waiting--
+		if b.waiting == 0 {
+			close(b.release)
+		}
+	}
+	b.mu.Unlock()
+	<-b.release
+}
+
+// addRow adds an organization's row with the given available and purchased
+// license counts
+func (f *fakeSheet) addRow(org string, available, purchased int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := int64(100 + len(f.rows))
+	f.history[id] = []interface{}{float64(available)}
+	f.rows = append(f.rows, &Row{
+		ID:      id,
+		Version: 1,
+		Cells: []Cell{
+			{ColumnID: orgColumnID, Value: org},
+			{ColumnID: availableColumnID, Value: float64(available)},
+			{ColumnID: purchasedColumnID, Value: float64(purchased)},
+		},
+	})
+}
+
+// available returns the available license count of an organization's row
+func (f *fakeSheet) available(org string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	row := f.rowByOrg(org)
+	if row == nil {
+		f.t.Fatalf("no row for org %s", org)
+	}
+	return int(cellValue(row, availableColumnID).(float64))
+}
+
+func (f *fakeSheet) rowByOrg(org string) *Row {
+	for _, row := range f.rows {
+		if cellValue(row, orgColumnID) == org {
+			return row
+		}
+	}
+	return nil
+}
+
+func (f *fakeSheet) rowByID(id int64) *Row {
+	for _, row := range f.rows {
+		if row.ID == id {
+			return row
+		}
+	}
+	return nil
+}
+
+func cellValue(row *Row, columnID int64) interface{} {
+	for _, cell := range row.Cells {
+		if cell.ColumnID == columnID {
+			return cell.Value
+		}
+	}
+	return nil
+}
+
+func (f *fakeSheet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	sheet := fmt.Sprintf("/sheets/%d", testSheetID)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == sheet:
+		f.getSheet(w)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, sheet+"/rows/"):
+		// /rows/{rowId} or /rows/{rowId}/columns/{columnId}/history
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, sheet+"/rows/"), "/")
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		switch {
+		case err != nil:
+			w.WriteHeader(http.StatusNotFound)
+		case len(parts) == 1:
+			if f.rowReads != nil {
+				f.rowReads.wait()
+			}
+			f.getRow(w, id)
+		case len(parts) == 4 && parts[1] == "columns" && parts[2] == strconv.Itoa(availableColumnID) && parts[3] == "history":
+			pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+			f.getHistory(w, id, pageSize)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut && r.URL.Path == sheet+"/rows":
+		f.updateRows(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeSheet) getSheet(w http.ResponseWriter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	json.NewEncoder(w).Encode(Sheet{
+		Columns: []Column{
+			{ID: orgColumnID, Title: "Organization"},
+			{ID: availableColumnID, Title: "Available"},
+			{ID: purchasedColumnID, Title: "Purchased"},
+		},
+		Rows: derefRows(f.rows),
+	})
+}
+
+func (f *fakeSheet) getRow(w http.ResponseWriter, id int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failRowReads {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	row := f.rowByID(id)
+	if row == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(row)
+}
+
+func (f *fakeSheet) getHistory(w http.ResponseWriter, id int64, pageSize int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	history := f.history[id]
+	if pageSize > 0 && pageSize < len(history) {
+		history = history[:pageSize]
+	}
+	data := make([]Cell, len(history))
+	for i, value := range history {
+		data[i] = Cell{ColumnID: availableColumnID, Value: value}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"totalCount": len(f.history[id]), "data": data})
+}
+
+func (f *fakeSheet) updateRows(w http.ResponseWriter, r *http.Request) {
+	var updates []Row
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rejectWrites {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var result []Row
+	for _, update := range updates {
+		row := f.rowByID(update.ID)
+		if row == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.writes++
+		if f.beforeWrite != nil {
+			f.beforeWrite(f.writes)
+		}
+		f.write(row, update.Cells)
+		result = append(result, *row)
+		if f.afterWrite != nil {
+			f.afterWrite(f.writes)
+		}
+	}
+	if f.omitResult {
+		result = nil
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "SUCCESS", "result": result})
+}
+
+// write applies cells to a row. The caller must hold mu.
+func (f *fakeSheet) write(row *Row, cells []Cell) {
+	for _, cell := range cells {
+		for i := range row.Cells {
+			if row.Cells[i].ColumnID == cell.ColumnID {
+				row.Cells[i].Value = cell.Value
+			}
+		}
+		if cell.ColumnID == availableColumnID {
+			f.history[row.ID] = append([]interface{}{cell.Value}, f.history[row.ID]...)
+		}
+	}
+	row.Version++
+}
+
+// writeAvailable stands in for another writer setting an organization's
+// available licenses. The caller must hold mu.
+func (f *fakeSheet) writeAvailable(org string, available int) {
+	f.write(f.rowByOrg(org), []Cell{{ColumnID: availableColumnID, Value: float64(available)}})
+}
+
+func derefRows(rows []*Row) []Row {
+	copied := make([]Row, len(rows))
+	for i, row := range rows {
+		copied[i] = *row
+	}
+	return copied
+}
+
+// newTestValidator returns a validator talking to a fake sheet
+func newTestValidator(t *testing.T, sheet *fakeSheet) *LicenseValidator {
+	t.Helper()
+	server := httptest.NewServer(sheet)
+	t.Cleanup(server.Close)
+	return NewLicenseValidatorWithBaseURL("test-token", testSheetID, testColumns, server.URL+"/")
+}
+
+func TestRefresh(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 5, 10)
+	sheet.addRow("globex", 0, 3)
+
+	v := newTestValidator(t, sheet)
+	licenses, err := v.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []license.License{
+		{Organization: "acme", Available: 5, Purchased: 10},
+		{Organization: "globex", Available: 0, Purchased: 3},
+	}
+	if len(licenses) != len(want) {
+		t.Fatalf("licenses = %+v, want %+v", licenses, want)
+	}
+	for i := range want {
+		if licenses[i] != want[i] {
+			t.Errorf("licenses[%d] = %+v, want %+v", i, licenses[i], want[i])
+		}
+	}
+}
+
+func TestRefreshMissingColumn(t *testing.T) {
+	sheet := newFakeSheet(t)
+	server := httptest.NewServer(sheet)
+	defer server.Close()
+
+	columns := testColumns
+	columns.CostCenter = "Cost Center"
+	v := NewLicenseValidatorWithBaseURL("test-token", testSheetID, columns, server.URL)
+
+	var columnErr *ColumnError
+	if err := v.Refresh(); !errors.As(err, &columnErr) || columnErr.Key != "cost_center" {
+		t.Errorf("err = %v, want a ColumnError for cost_center", err)
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 5, 10)
+
+	v := newTestValidator(t, sheet)
+	if got, err := v.Available("acme"); err != nil || got != 5 {
+		t.Errorf("Available(acme) = %d, %v, want 5", got, err)
+	}
+	if got, err := v.Available("initech"); err != nil || got != 0 {
+		t.Errorf("Available(initech) = %d, %v, want 0", got, err)
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 2, 10)
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); err != nil {
+		t.Fatalf("Adjust: %v", err)
+	}
+	if got := sheet.available("acme"); got != 1 {
+		t.Errorf("sheet available = %d, want 1", got)
+	}
+	if got, _ := v.Available("acme"); got != 1 {
+		t.Errorf("cached available = %d, want 1", got)
+	}
+
+	if err := v.Adjust("acme", -2); !errors.Is(err, license.ErrNoLicenses) {
+		t.Errorf("err = %v, want ErrNoLicenses", err)
+	}
+	if got := sheet.available("acme"); got != 1 {
+		t.Errorf("sheet available = %d after refused adjustment, want 1", got)
+	}
+}
+
+func TestAdjustAfterExternalChange(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 1, 10)
+
+	v := newTestValidator(t, sheet)
+	if _, err := v.Available("acme"); err != nil {
+		t.Fatalf("Available: %v", err)
+	}
+
+	// Someone else takes the last license after the sheet was cached
+	other := newTestValidator(t, sheet)
+	if err := other.Adjust("acme", -1); err != nil {
+		t.Fatalf("Adjust: %v", err)
+	}
+
+	if err := v.Adjust("acme", -1); !errors.Is(err, license.ErrLicenseTaken) {
+		t.Errorf("err = %v, want ErrLicenseTaken", err)
+	}
+	if got := sheet.available("acme"); got != 0 {
+		t.Errorf("sheet available = %d, want 0", got)
+	}
+}
+
+func TestAdjustRejectedWrite(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 2, 10)
+
+	v := newTestValidator(t, sheet)
+	if _, err := v.Available("acme"); err != nil {
+		t.Fatalf("Available: %v", err)
+	}
+
+	sheet.mu.Lock()
+	sheet.rejectWrites = true
+	sheet.mu.Unlock()
+
+	if err := v.Adjust("acme", -1); err == nil {
+		t.Fatal("expected an error when the sheet rejects the write")
+	}
+	if got, _ := v.Available("acme"); got != 2 {
+		t.Errorf("cached available = %d after rejected write, want 2", got)
+	}
+}
+
+func TestAdjustUnknownOrg(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 2, 10)
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("initech", 1); err == nil {
+		t.Error("expected an error for an org without a row")
+	}
+}
+
+func TestSetAvailable(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 2, 10)
+
+	v := newTestValidator(t, sheet)
+	if err := v.SetAvailable("acme", 7); err != nil {
+		t.Fatalf("SetAvailable: %v", err)
+	}
+	if got := sheet.available("acme"); got != 7 {
+		t.Errorf("sheet available = %d, want 7", got)
+	}
+}
+
+// adjustConcurrently has every validator take delta from an org's licenses
+// after all of them have read the row, and returns their errors
+func adjustConcurrently(t *testing.T, sheet *fakeSheet, validators []*LicenseValidator, org string, delta int) []error {
+	t.Helper()
+	for _, v := range validators {
+		if _, err := v.Available(org); err != nil {
+			t.Fatalf("Available: %v", err)
+		}
+	}
+
+	sheet.mu.Lock()
+	sheet.rowReads = newBarrier(len(validators))
+	sheet.mu.Unlock()
+
+	errs := make([]error, len(validators))
+	var wg sync.WaitGroup
+	for i, v := range validators {
+		wg.Add(1)
+		go func(i int, v *LicenseValidator) {
+			defer wg.Done()
+			errs[i] = v.Adjust(org, delta)
+		}(i, v)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestAdjustConcurrentLastLicense(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 1, 10)
+
+	validators := []*LicenseValidator{newTestValidator(t, sheet), newTestValidator(t, sheet)}
+	errs := adjustConcurrently(t, sheet, validators, "acme", -1)
+
+	succeeded := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, license.ErrLicenseTaken):
+			t.Errorf("err = %v, want nil or ErrLicenseTaken", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d validators took the last license, want 1", succeeded)
+	}
+	if got := sheet.available("acme"); got != 0 {
+		t.Errorf("sheet available = %d, want 0", got)
+	}
+}
+
+func TestAdjustConcurrentRetriesOverwrittenUpdate(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 2, 10)
+
+	validators := []*LicenseValidator{newTestValidator(t, sheet), newTestValidator(t, sheet)}
+	for _, err := range adjustConcurrently(t, sheet, validators, "acme", -1) {
+		if err != nil {
+			t.Errorf("Adjust: %v", err)
+		}
+	}
+	if got := sheet.available("acme"); got != 0 {
+		t.Errorf("sheet available = %d, want 0", got)
+	}
+}
+
+func TestAdjustUnknownVersion(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 2, 10)
+	sheet.omitResult = true
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); err != nil {
+		t.Fatalf("Adjust: %v", err)
+	}
+	if got := sheet.available("acme"); got != 1 {
+		t.Errorf("sheet available = %d, want 1", got)
+	}
+}
+
+func TestAdjustUnknownVersionUnreadable(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 2, 10)
+	sheet.omitResult = true
+	sheet.afterWrite = func(int) { sheet.failRowReads = true }
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); !errors.Is(err, license.ErrOutcomeUnknown) {
+		t.Errorf("err = %v, want ErrOutcomeUnknown", err)
+	}
+	if got := sheet.available("acme"); got != 1 {
+		t.Errorf("sheet available = %d, want our write of 1", got)
+	}
+}
+
+func TestAdjustRestoresOverwrittenUpdate(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 3, 10)
+	// Another writer takes a license between our read and our write
+	sheet.beforeWrite = func(n int) {
+		if n == 1 {
+			sheet.writeAvailable("acme", 2)
+		}
+	}
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); err != nil {
+		t.Fatalf("Adjust: %v", err)
+	}
+	if got := sheet.available("acme"); got != 1 {
+		t.Errorf("sheet available = %d, want 1", got)
+	}
+}
+
+func TestAdjustOverwrittenLastLicense(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 1, 10)
+	sheet.beforeWrite = func(n int) {
+		if n == 1 {
+			sheet.writeAvailable("acme", 0)
+		}
+	}
+
+	// Our write is undone by the restore, so the license is known to be taken
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); !errors.Is(err, license.ErrLicenseTaken) {
+		t.Errorf("err = %v, want ErrLicenseTaken", err)
+	}
+	if got := sheet.available("acme"); got != 0 {
+		t.Errorf("sheet available = %d, want 0", got)
+	}
+}
+
+func TestAdjustRowChangedBeforeRestore(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 3, 10)
+	sheet.beforeWrite = func(n int) {
+		if n == 1 {
+			sheet.writeAvailable("acme", 2)
+		}
+	}
+	// A third writer lands after ours, so the cell history no longer says
+	// what we overwrote
+	sheet.afterWrite = func(n int) {
+		if n == 1 {
+			sheet.writeAvailable("acme", 1)
+		}
+	}
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); !errors.Is(err, license.ErrOutcomeUnknown) {
+		t.Errorf("err = %v, want ErrOutcomeUnknown", err)
+	}
+	if got := sheet.writes; got != 1 {
+		t.Errorf("%d writes, want only ours", got)
+	}
+}
+
+func TestAdjustHistoryWithoutOurWrite(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 3, 10)
+	sheet.beforeWrite = func(n int) {
+		if n == 1 {
+			sheet.writeAvailable("acme", 1)
+		}
+	}
+	sheet.afterWrite = func(n int) {
+		if n == 1 {
+			id := sheet.rowByOrg("acme").ID
+			sheet.history[id] = sheet.history[id][1:]
+		}
+	}
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); !errors.Is(err, license.ErrOutcomeUnknown) {
+		t.Errorf("err = %v, want ErrOutcomeUnknown", err)
+	}
+	if got := sheet.writes; got != 1 {
+		t.Errorf("%d writes, want only ours", got)
+	}
+}
+
+func TestAdjustRestoreOverwritesThirdWriter(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 3, 10)
+	sheet.beforeWrite = func(n int) {
+		// The first writer lands before our write, a third one just before
+		// our restore
+		switch n {
+		case 1:
+			sheet.writeAvailable("acme", 2)
+		case 2:
+			sheet.writeAvailable("acme", 1)
+		}
+	}
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); !errors.Is(err, license.ErrOutcomeUnknown) {
+		t.Errorf("err = %v, want ErrOutcomeUnknown", err)
+	}
+}
+
+func TestAdjustRestoreUnreadable(t *testing.T) {
+	sheet := newFakeSheet(t)
+	sheet.addRow("acme", 3, 10)
+	sheet.beforeWrite = func(n int) {
+		if n == 1 {
+			sheet.writeAvailable("acme", 2)
+		}
+	}
+	sheet.afterWrite = func(n int) {
+		if n == 2 {
+			sheet.omitResult = true
+			sheet.failRowReads = true
+		}
+	}
+
+	v := newTestValidator(t, sheet)
+	if err := v.Adjust("acme", -1); !errors.Is(err, license.ErrOutcomeUnknown) {
+		t.Errorf("err = %v, want ErrOutcomeUnknown", err)
+	}
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github-copilot-invite/internal/auth"
 	"github-copilot-invite/internal/config"
+	"github-copilot-invite/internal/desired"
 	"github-copilot-invite/internal/logger"
 	"github-copilot-invite/internal/server"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
@@ -34,9 +43,92 @@ func init() {
 }
 
 func main() {
+	// Run a one-off command if one was given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reconcile":
+			reconcile(os.Args[2:])
+			return
+		case "plan", "apply":
+			desiredState(os.Args[1], os.Args[2:])
+			return
+		case "hash-token":
+			hashToken()
+			return
+		}
+	}
+
 	// Create and start server
 	srv := server.New()
 	if err := srv.Start(); err != nil {
 		log.Fatal().Err(err).Msg("Server error")
 	}
 }
+
+// reconcile compares the license sheet with GitHub and prints the report
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "correct the available licenses in the sheet")
+	flags.Parse(args)
+
+	report, err := server.NewReconciler(server.NewConfig()).Run(*apply)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Reconciliation failed")
+	}
+	printJSON(report)
+}
+
+// desiredState plans or applies a desired state file and prints the plan
+func desiredState(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	file := flags.String("f", "copilot.yaml", "desired state file")
+	flags.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open desired state file")
+	}
+	defer f.Close()
+
+	doc, err := desired.Parse(f)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid desired state file")
+	}
+
+	planner := server.NewPlanner(server.NewConfig())
+	var plan *desired.Plan
+	if command == "apply" {
+		plan, err = planner.Apply(doc)
+	} else {
+		plan, err = planner.Plan(doc)
+	}
+	if plan != nil {
+		printJSON(plan)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Failed to %s desired state", command)
+	}
+}
+
+// hashToken reads an API client token from stdin and prints the token_hash
+// to configure for it
+func hashToken() {
+	token, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal().Err(err).Msg("Failed to read token")
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		log.Fatal().Msg("No token given on stdin")
+	}
+	fmt.Println(auth.HashToken(token))
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatal().Err(err).Msg("Failed to write output")
+	}
+}